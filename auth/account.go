@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+)
+
+// oobCode request types for accounts:sendOobCode
+const (
+	OobVerifyEmail   = "VERIFY_EMAIL"
+	OobPasswordReset = "PASSWORD_RESET"
+	OobEmailSignIn   = "EMAIL_SIGNIN"
+)
+
+// FBAccountResp is returned by accounts:update. The tokens are only set when the change
+// invalidated the caller's session (email or password changes).
+type FBAccountResp struct {
+	UID           string `json:"localId"`
+	Email         string `json:"email"`
+	DisplayName   string `json:"displayName"`
+	EmailVerified bool   `json:"emailVerified"`
+	IDToken       string `json:"idToken"`
+	RefreshToken  string `json:"refreshToken"`
+	ExpiresIn     string `json:"expiresIn"`
+
+	ProviderUserInfo []FBProviderInfo `json:"providerUserInfo"`
+}
+
+// FBProviderInfo describes a provider linked to an account
+type FBProviderInfo struct {
+	ProviderID  string `json:"providerId"`
+	FederatedID string `json:"federatedId"`
+	Email       string `json:"email"`
+	DisplayName string `json:"displayName"`
+	PhotoURL    string `json:"photoUrl"`
+}
+
+type fbResetPasswordResp struct {
+	Email       string `json:"email"`
+	RequestType string `json:"requestType"`
+}
+
+// SignUp creates an email/password account and signs it in
+func (f *FirebaseAuth) SignUp(ctx context.Context, email string, password string) (*FBLoginResp, error) {
+	if err := f.checkPassword(ctx, password, email); err != nil {
+		return nil, err
+	}
+
+	var resp FBLoginResp
+
+	err := f.postJSON(ctx, "/accounts:signUp", map[string]interface{}{
+		"email":             email,
+		"password":          password,
+		"returnSecureToken": true,
+	}, &resp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// SendEmailVerification emails a verification link to the user owning idToken
+func (f *FirebaseAuth) SendEmailVerification(ctx context.Context, idToken string) error {
+	return f.postJSON(ctx, "/accounts:sendOobCode", map[string]interface{}{
+		"requestType": OobVerifyEmail,
+		"idToken":     idToken,
+	}, nil)
+}
+
+// SendPasswordResetEmail emails a password reset link to email
+func (f *FirebaseAuth) SendPasswordResetEmail(ctx context.Context, email string) error {
+	err := f.postJSON(ctx, "/accounts:sendOobCode", map[string]interface{}{
+		"requestType": OobPasswordReset,
+		"email":       email,
+	}, nil)
+	f.audit(ctx, &AuditEvent{Type: AuditPasswordResetLink, Details: map[string]interface{}{"email": email}}, err)
+
+	return err
+}
+
+// VerifyPasswordResetCode checks a password reset oobCode and returns the email it belongs to
+func (f *FirebaseAuth) VerifyPasswordResetCode(ctx context.Context, oobCode string) (string, error) {
+	var resp fbResetPasswordResp
+
+	if err := f.postJSON(ctx, "/accounts:resetPassword", map[string]interface{}{
+		"oobCode": oobCode,
+	}, &resp); err != nil {
+		return "", err
+	}
+
+	return resp.Email, nil
+}
+
+// ConfirmPasswordReset sets a new password using the oobCode from a reset email and returns the account email
+func (f *FirebaseAuth) ConfirmPasswordReset(ctx context.Context, oobCode string, newPassword string) (string, error) {
+	if f.passwordPolicy != nil {
+		// the code is only checked here, it is consumed by the reset below
+		email, err := f.VerifyPasswordResetCode(ctx, oobCode)
+		if err != nil {
+			return "", err
+		}
+		if err = f.checkPassword(ctx, newPassword, email); err != nil {
+			return "", err
+		}
+	}
+
+	var resp fbResetPasswordResp
+
+	err := f.postJSON(ctx, "/accounts:resetPassword", map[string]interface{}{
+		"oobCode":     oobCode,
+		"newPassword": newPassword,
+	}, &resp)
+	f.audit(ctx, &AuditEvent{Type: AuditPasswordReset, Details: map[string]interface{}{"email": resp.Email}}, err)
+
+	if err != nil {
+		return "", err
+	}
+
+	return resp.Email, nil
+}
+
+// ConfirmEmailVerification applies the oobCode from a verification email
+func (f *FirebaseAuth) ConfirmEmailVerification(ctx context.Context, oobCode string) (*FBAccountResp, error) {
+	return f.updateAccount(ctx, map[string]interface{}{
+		"oobCode": oobCode,
+	})
+}
+
+// ChangeEmail changes the email of the user owning idToken. The returned tokens replace the old ones.
+func (f *FirebaseAuth) ChangeEmail(ctx context.Context, idToken string, email string) (*FBAccountResp, error) {
+	return f.updateAccount(ctx, map[string]interface{}{
+		"idToken":           idToken,
+		"email":             email,
+		"returnSecureToken": true,
+	})
+}
+
+// ChangePassword changes the password of the user owning idToken. The returned tokens replace the old ones.
+func (f *FirebaseAuth) ChangePassword(ctx context.Context, idToken string, password string) (*FBAccountResp, error) {
+	if err := f.checkPassword(ctx, password, f.idTokenEmail(ctx, idToken)); err != nil {
+		return nil, err
+	}
+
+	resp, err := f.updateAccount(ctx, map[string]interface{}{
+		"idToken":           idToken,
+		"password":          password,
+		"returnSecureToken": true,
+	})
+
+	event := &AuditEvent{Type: AuditPasswordChanged}
+	if resp != nil {
+		event.UID = resp.UID
+	}
+	f.audit(ctx, event, err)
+
+	return resp, err
+}
+
+// DeleteAccount deletes the user owning idToken
+func (f *FirebaseAuth) DeleteAccount(ctx context.Context, idToken string) error {
+	uid := tokenSubject(idToken)
+
+	err := f.postJSON(ctx, "/accounts:delete", map[string]interface{}{
+		"idToken": idToken,
+	}, nil)
+	f.audit(ctx, &AuditEvent{Type: AuditAccountDeleted, UID: uid, Details: map[string]interface{}{"self_service": true}}, err)
+
+	if err != nil {
+		return err
+	}
+
+	f.invalidateCachedTokens(uid)
+
+	return nil
+}
+
+// updateAccount calls accounts:update
+func (f *FirebaseAuth) updateAccount(ctx context.Context, req map[string]interface{}) (*FBAccountResp, error) {
+	var resp FBAccountResp
+
+	if err := f.postJSON(ctx, "/accounts:update", req, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
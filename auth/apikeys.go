@@ -0,0 +1,539 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// APIKeyHeader carries the API key of machine clients
+const APIKeyHeader = "X-API-Key"
+
+// SourceAPIKey marks a Principal authenticated with an API key
+const SourceAPIKey = "api_key"
+
+// APIKeyIDClaim holds the key ID in the Claims of an API key Principal
+const APIKeyIDClaim = "api_key_id"
+
+// DefaultAPIKeyOwnerTTL is how long the owner's account state is reused when APIKeyConfig.OwnerTTL is 0
+const DefaultAPIKeyOwnerTTL = time.Minute
+
+var (
+	ErrUnknownAPIKey = errors.New("unknown or revoked api key")
+	ErrAPIKeyExpired = errors.New("api key expired")
+)
+
+// UserGetter looks up accounts, e.g. *FirebaseAuth or *FakeAuth
+type UserGetter interface {
+	GetUserContext(ctx context.Context, uid string) (*auth.UserRecord, error)
+}
+
+var (
+	_ UserGetter = (*FirebaseAuth)(nil)
+	_ UserGetter = (*FakeAuth)(nil)
+)
+
+// APIKey is the stored record of an issued key. The secret itself is never stored, only its salted hash.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner"` // UID the key acts as
+	Tenant    string    `json:"tenant,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Roles     []string  `json:"roles,omitempty"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"` // zero for keys that do not expire
+	Salt      string    `json:"salt"`
+	Hash      string    `json:"hash"`
+}
+
+// APIKeySpec describes a key to issue
+type APIKeySpec struct {
+	Name   string
+	Roles  []string // become Principal.Roles, limited to the owner's current roles when Users is set
+	Scopes []string // become Principal.Permissions
+	TTL    time.Duration
+	Tenant string // the owner's tenant, taken from the account when Users is set
+}
+
+// APIKeyConfig configures an APIKeyManager. Zero values take the defaults noted below.
+type APIKeyConfig struct {
+	Prefix    string // prefix of issued keys, identifies them in logs and secret scanners, default "ak"
+	KeyPrefix string // Store key prefix, default "apikey:"
+
+	// Users ties keys to their owner's account: keys stop working once the owner is disabled, deleted or
+	// signed out everywhere after the key was issued, and the Principal takes its roles from the owner's
+	// current custom claims. Without it keys keep the roles they were issued with until revoked.
+	Users UserGetter
+
+	// OwnerTTL is how long an owner's account state is reused, default DefaultAPIKeyOwnerTTL
+	OwnerTTL time.Duration
+}
+
+// APIKeyManager issues, verifies, rotates and revokes API keys of the form <prefix>_<id>_<secret>
+type APIKeyManager struct {
+	store Store
+	cfg   APIKeyConfig
+	now   func() time.Time
+
+	mu     sync.Mutex
+	owners map[string]apiKeyOwner
+}
+
+type apiKeyOwner struct {
+	user    *auth.UserRecord
+	err     error
+	expires time.Time
+}
+
+// NewAPIKeyManager keeps the key records in store, e.g. a *storage.MemStore or a *LocalStore
+func NewAPIKeyManager(store Store, cfg APIKeyConfig) *APIKeyManager {
+	if cfg.Prefix == "" {
+		cfg.Prefix = "ak"
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = "apikey:"
+	}
+	if cfg.OwnerTTL <= 0 {
+		cfg.OwnerTTL = DefaultAPIKeyOwnerTTL
+	}
+
+	return &APIKeyManager{
+		store:  store,
+		cfg:    cfg,
+		now:    time.Now,
+		owners: make(map[string]apiKeyOwner),
+	}
+}
+
+// SetClock replaces time.Now, for tests
+func (m *APIKeyManager) SetClock(now func() time.Time) {
+	m.now = now
+}
+
+// Issue creates a key for owner and returns it with its record. The key is only available here.
+func (m *APIKeyManager) Issue(ctx context.Context, owner string, spec APIKeySpec) (string, *APIKey, error) {
+	if owner == "" {
+		return "", nil, errors.New("api key needs an owner")
+	}
+
+	tenant := spec.Tenant
+	if m.cfg.Users != nil {
+		user, err := m.owner(ctx, owner, true)
+		if err != nil {
+			return "", nil, err
+		}
+		if user.TenantID != "" {
+			tenant = user.TenantID
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomKey(32)
+	if err != nil {
+		return "", nil, err
+	}
+	salt, err := randomHex(16)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := &APIKey{
+		ID:        id,
+		Owner:     owner,
+		Tenant:    tenant,
+		Name:      spec.Name,
+		Roles:     dedupe(spec.Roles),
+		Scopes:    dedupe(spec.Scopes),
+		CreatedAt: m.now().UTC(),
+		Salt:      salt,
+		Hash:      hashAPIKeySecret(salt, secret),
+	}
+	if spec.TTL > 0 {
+		key.ExpiresAt = key.CreatedAt.Add(spec.TTL)
+	}
+
+	if err = m.save(key); err != nil {
+		return "", nil, err
+	}
+	if err = m.updateOwnerIndex(owner, id, true); err != nil {
+		return "", nil, err
+	}
+
+	return m.cfg.Prefix + "_" + id + "_" + secret, key, nil
+}
+
+// Verify checks key and, when Users is set, that its owner can still sign in, and returns its record
+func (m *APIKeyManager) Verify(ctx context.Context, key string) (*APIKey, error) {
+	record, _, err := m.verify(ctx, key)
+	return record, err
+}
+
+// Authenticate verifies key and returns its Principal, with the owner's current roles when Users is set
+func (m *APIKeyManager) Authenticate(ctx context.Context, key string) (*Principal, error) {
+	record, user, err := m.verify(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	p := PrincipalFromAPIKey(record)
+	if user != nil {
+		p.Roles = ownerRoles(record.Roles, RolesFromClaims(user.CustomClaims))
+		p.Email = user.Email
+		p.EmailVerified = user.EmailVerified
+	}
+
+	return p, nil
+}
+
+// verify returns the owner's record too, nil without Users
+func (m *APIKeyManager) verify(ctx context.Context, key string) (*APIKey, *auth.UserRecord, error) {
+	id, secret, ok := m.split(key)
+	if !ok {
+		return nil, nil, ErrUnknownAPIKey
+	}
+
+	record, err := m.Get(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(record.Salt, secret)), []byte(record.Hash)) != 1 {
+		return nil, nil, ErrUnknownAPIKey
+	}
+	if !record.ExpiresAt.IsZero() && !m.now().Before(record.ExpiresAt) {
+		return nil, nil, ErrAPIKeyExpired
+	}
+
+	if m.cfg.Users == nil {
+		return record, nil, nil
+	}
+
+	user, err := m.owner(ctx, record.Owner, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	// signing out everywhere revokes the keys issued before it, like the refresh tokens. Firebase keeps
+	// the time in whole seconds, so a key issued in the same second counts as revoked.
+	if user.TokensValidAfterMillis > 0 && user.TokensValidAfterMillis/1000 >= record.CreatedAt.Unix() {
+		return nil, nil, fmt.Errorf("%w: owner signed out", ErrUnknownAPIKey)
+	}
+
+	return record, user, nil
+}
+
+// owner returns the owner's account if it exists and is enabled, cached for OwnerTTL unless fresh is set
+func (m *APIKeyManager) owner(ctx context.Context, uid string, fresh bool) (*auth.UserRecord, error) {
+	m.mu.Lock()
+	cached, ok := m.owners[uid]
+	m.mu.Unlock()
+
+	if !ok || fresh || !m.now().Before(cached.expires) {
+		cached.user, cached.err = m.cfg.Users.GetUserContext(ctx, uid)
+		if cached.err != nil && (auth.IsUserNotFound(cached.err) || errors.Is(cached.err, ErrUserNotFound)) {
+			cached.err = fmt.Errorf("%w: owner deleted", ErrUnknownAPIKey)
+		}
+		if cached.err == nil && cached.user.Disabled {
+			cached.err = fmt.Errorf("%w: %w", ErrUnknownAPIKey, ErrUserDisabled)
+		}
+
+		// outages are not cached, so the next request tries again
+		if cached.err == nil || errors.Is(cached.err, ErrUnknownAPIKey) {
+			cached.expires = m.now().Add(m.cfg.OwnerTTL)
+			m.mu.Lock()
+			m.owners[uid] = cached
+			m.mu.Unlock()
+		}
+	}
+
+	return cached.user, cached.err
+}
+
+// ownerRoles limits the key's roles to those the owner still holds. A key issued without roles acts
+// with all of the owner's roles.
+func ownerRoles(keyRoles []string, current []string) []string {
+	if len(keyRoles) == 0 {
+		return current
+	}
+
+	roles := make([]string, 0, len(keyRoles))
+	for _, role := range keyRoles {
+		if contains(current, role) {
+			roles = append(roles, role)
+		}
+	}
+
+	return roles
+}
+
+// Get returns the record of key ID id
+func (m *APIKeyManager) Get(ctx context.Context, id string) (*APIKey, error) {
+	var record APIKey
+	if err := m.store.GetKey(m.key(id), &record); err != nil {
+		return nil, err
+	}
+	if record.ID == "" {
+		return nil, ErrUnknownAPIKey
+	}
+
+	return &record, nil
+}
+
+// List returns the keys of owner that have not been revoked or expired from the store
+func (m *APIKeyManager) List(ctx context.Context, owner string) ([]*APIKey, error) {
+	ids, err := m.ownerIndex(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*APIKey, 0, len(ids))
+	for _, id := range ids {
+		record, err := m.Get(ctx, id)
+		if errors.Is(err, ErrUnknownAPIKey) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, record)
+	}
+
+	return keys, nil
+}
+
+// Revoke deletes key ID id. Revoking an unknown key is not an error.
+func (m *APIKeyManager) Revoke(ctx context.Context, id string) error {
+	record, err := m.Get(ctx, id)
+	if errors.Is(err, ErrUnknownAPIKey) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	m.store.DeleteKey(m.key(id))
+
+	return m.updateOwnerIndex(record.Owner, id, false)
+}
+
+// RevokeAll deletes every key of owner and the owner's index, e.g. when the account is deleted, and
+// returns the number of keys revoked
+func (m *APIKeyManager) RevokeAll(ctx context.Context, owner string) (int, error) {
+	ids, err := m.ownerIndex(owner)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, id := range ids {
+		// false means the key expired or was revoked in the meantime
+		if m.store.DeleteKey(m.key(id)) {
+			count++
+		}
+	}
+	m.store.DeleteKey(m.cfg.KeyPrefix + "owner:" + owner)
+
+	return count, nil
+}
+
+// Rotate issues a replacement for key ID id with the same owner, name, roles, scopes and expiry.
+// The old key keeps working for grace, so clients can switch over; a grace of 0 revokes it now.
+func (m *APIKeyManager) Rotate(ctx context.Context, id string, grace time.Duration) (string, *APIKey, error) {
+	old, err := m.Get(ctx, id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	spec := APIKeySpec{Name: old.Name, Roles: old.Roles, Scopes: old.Scopes, Tenant: old.Tenant}
+	if !old.ExpiresAt.IsZero() {
+		if spec.TTL = old.ExpiresAt.Sub(m.now()); spec.TTL <= 0 {
+			return "", nil, ErrAPIKeyExpired
+		}
+	}
+
+	key, record, err := m.Issue(ctx, old.Owner, spec)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if grace <= 0 {
+		err = m.Revoke(ctx, id)
+	} else if until := m.now().UTC().Add(grace); old.ExpiresAt.IsZero() || until.Before(old.ExpiresAt) {
+		old.ExpiresAt = until
+		err = m.save(old)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	return key, record, nil
+}
+
+// Middleware authenticates the X-API-Key header and stores the key's Principal in the request context.
+// WithOptional, WithOptionalPaths, WithTenant and WithErrorHandler apply.
+func (m *APIKeyManager) Middleware(opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	cfg := newMiddlewareConfig(opts)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			value := r.Header.Get(APIKeyHeader)
+
+			if value == "" {
+				if cfg.isOptional(r) {
+					next.ServeHTTP(w, r)
+				} else {
+					cfg.errorHandler(w, r, ErrMissingToken)
+				}
+				return
+			}
+
+			p, err := m.Authenticate(r.Context(), value)
+			if err != nil {
+				cfg.errorHandler(w, r, err)
+				return
+			}
+			if cfg.tenantID != "" && p.Tenant != cfg.tenantID {
+				cfg.errorHandler(w, r, fmt.Errorf("%w: %w", ErrInvalidToken, ErrTenantMismatch))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), p)))
+		})
+	}
+}
+
+// WithAPIKeys also accepts the X-API-Key header in a Resolver, ahead of the bearer token
+func WithAPIKeys(m *APIKeyManager) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.apiKeys = m
+	}
+}
+
+// PrincipalFromAPIKey builds the Principal of a verified key with the roles it was issued with.
+// Use APIKeyManager.Authenticate for the owner's current roles.
+func PrincipalFromAPIKey(key *APIKey) *Principal {
+	return &Principal{
+		UID:            key.Owner,
+		Tenant:         key.Tenant,
+		SignInProvider: SourceAPIKey,
+		Roles:          key.Roles,
+		Permissions:    key.Scopes,
+		Claims:         map[string]interface{}{APIKeyIDClaim: key.ID},
+		Source:         SourceAPIKey,
+	}
+}
+
+// split parses <prefix>_<id>_<secret>. The secret is base64url and may itself contain "_".
+func (m *APIKeyManager) split(key string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(key, m.cfg.Prefix+"_")
+	if !ok {
+		return "", "", false
+	}
+
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return "", "", false
+	}
+
+	return id, secret, true
+}
+
+// save writes the record, letting the store expire it with the key
+func (m *APIKeyManager) save(key *APIKey) error {
+	expiry := 0
+	if !key.ExpiresAt.IsZero() {
+		if expiry = int(key.ExpiresAt.Sub(m.now()).Seconds()) + 1; expiry < 1 {
+			expiry = 1
+		}
+	}
+
+	if !m.store.SaveKey(m.key(key.ID), key, expiry) {
+		return fmt.Errorf("failed to save api key %v", key.ID)
+	}
+
+	return nil
+}
+
+// ownerIndex returns the key IDs issued to owner
+func (m *APIKeyManager) ownerIndex(owner string) ([]string, error) {
+	var ids []string
+	if err := m.store.GetKey(m.cfg.KeyPrefix+"owner:"+owner, &ids); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// updateOwnerIndex adds or removes id. Like MergeCustomClaims this read-modify-write is not atomic.
+func (m *APIKeyManager) updateOwnerIndex(owner string, id string, add bool) error {
+	ids, err := m.ownerIndex(owner)
+	if err != nil {
+		return err
+	}
+
+	kept := make([]string, 0, len(ids)+1)
+	for _, existing := range ids {
+		if existing != id {
+			kept = append(kept, existing)
+		}
+	}
+	if add {
+		kept = append(kept, id)
+	}
+
+	if !m.store.SaveKey(m.cfg.KeyPrefix+"owner:"+owner, kept, 0) {
+		return fmt.Errorf("failed to save api key index for %v", owner)
+	}
+
+	return nil
+}
+
+// key
+func (m *APIKeyManager) key(id string) string {
+	return m.cfg.KeyPrefix + "id:" + id
+}
+
+// hashAPIKeySecret
+func hashAPIKeySecret(salt string, secret string) string {
+	sum := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// randomKey returns n random bytes base64url encoded
+func randomKey(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Audit event types, the action that was performed
+const (
+	AuditTokensRevoked     = "tokens.revoked"
+	AuditSignedOut         = "account.signed_out"
+	AuditAccountReenabled  = "account.reenabled"
+	AuditLogin             = "login"
+	AuditPasswordResetLink = "password.reset_link"
+	AuditPasswordReset     = "password.reset"
+	AuditPasswordChanged   = "password.changed"
+	AuditClaimsChanged     = "claims.changed"
+	AuditAccountDisabled   = "account.disabled"
+	AuditAccountEnabled    = "account.enabled"
+	AuditAccountDeleted    = "account.deleted"
+)
+
+// Audit outcomes
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditEvent records a security relevant action on an account
+type AuditEvent struct {
+	Type      string                 `json:"type"`
+	Outcome   string                 `json:"outcome"`
+	Actor     string                 `json:"actor,omitempty"` // UID of the caller, see ContextWithActor
+	UID       string                 `json:"uid,omitempty"`   // target account
+	Tenant    string                 `json:"tenant,omitempty"`
+	IP        string                 `json:"ip,omitempty"`
+	UserAgent string                 `json:"user_agent,omitempty"`
+	Time      time.Time              `json:"time"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+}
+
+// AuditSink receives audit events. Emit is called synchronously, so slow sinks should buffer.
+type AuditSink interface {
+	Emit(ctx context.Context, event *AuditEvent) error
+}
+
+// AuditSinkFunc adapts a function to AuditSink
+type AuditSinkFunc func(ctx context.Context, event *AuditEvent) error
+
+// Emit
+func (fn AuditSinkFunc) Emit(ctx context.Context, event *AuditEvent) error {
+	return fn(ctx, event)
+}
+
+// WithAuditSink emits audit events to sink for logins, password resets and changes, claim changes,
+// disables, deletions, revocations and forced sign-outs
+func WithAuditSink(sink AuditSink) Option {
+	return func(f *FirebaseAuth) {
+		f.auditSink = sink
+	}
+}
+
+// tokenSubject returns the UID of an ID or custom token without verifying it, for audit events of
+// calls Firebase verifies the token for. It is "" for a malformed token.
+func tokenSubject(token string) string {
+	t, err := parseJWT(token)
+	if err != nil {
+		return ""
+	}
+
+	if uid := t.str("uid"); uid != "" {
+		return uid
+	}
+
+	return t.str("sub")
+}
+
+// audit fills in the common fields and emits event. Failures are logged, never returned,
+// so a broken sink cannot block the operation being audited.
+func (f *FirebaseAuth) audit(ctx context.Context, event *AuditEvent, err error) {
+	emitAudit(ctx, f.auditSink, f.tenantID, event, err)
+}
+
+// emitAudit does the work of audit for any sink, which may be nil
+func emitAudit(ctx context.Context, sink AuditSink, tenant string, event *AuditEvent, err error) {
+	if sink == nil {
+		return
+	}
+
+	event.Tenant = tenant
+	event.Actor = ActorFromContext(ctx)
+	event.IP = ClientIPFromContext(ctx)
+	event.UserAgent = UserAgentFromContext(ctx)
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	event.Outcome = AuditSuccess
+	if err != nil {
+		event.Outcome = AuditFailure
+		event.Error = err.Error()
+	}
+
+	if err = sink.Emit(ctx, event); err != nil {
+		log.Printf("failed to emit audit event %v. %v", event.Type, err)
+	}
+}
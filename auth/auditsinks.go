@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vrus/gcp-golib/messaging"
+)
+
+// Publisher publishes to a Pub/Sub topic, e.g. *messaging.Publisher
+type Publisher interface {
+	PublishMessage(topic string, data []byte, attrs map[string]string) error
+}
+
+var _ Publisher = (*messaging.Publisher)(nil)
+
+// auditQueueSize is how many events a PublisherAuditSink holds while Pub/Sub catches up
+const auditQueueSize = 1000
+
+// DefaultAuditQueueTimeout is how long PublisherAuditSink.Emit waits for room in a full queue
+const DefaultAuditQueueTimeout = time.Second
+
+// ErrAuditQueueFull is returned by PublisherAuditSink.Emit when the event had to be dropped
+var ErrAuditQueueFull = errors.New("audit queue full")
+
+// PublisherAuditSink publishes audit events as JSON to a Pub/Sub topic, with the type, outcome
+// and tenant as attributes so subscriptions can filter on them. Events are queued and published
+// in the background, so a slow Pub/Sub only holds up the login or update being audited once the
+// queue is full, and then for at most the queue timeout.
+//
+// Events are lost when the queue stays full for longer than the timeout, e.g. during a burst of failed
+// logins while Pub/Sub is slow, and when publishing fails. Both are logged and counted by Dropped and
+// Failed; alert on them, or pair this sink with a JSONLinesAuditSink that cannot drop events.
+type PublisherAuditSink struct {
+	publisher Publisher
+	topic     string
+	timeout   time.Duration
+
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan *AuditEvent
+	done   chan struct{}
+}
+
+// NewPublisherAuditSink publishes to topic, which must be one of the publisher's topics.
+// Call Close on shutdown to publish the queued events.
+func NewPublisherAuditSink(publisher Publisher, topic string) *PublisherAuditSink {
+	s := &PublisherAuditSink{
+		publisher: publisher,
+		topic:     topic,
+		timeout:   DefaultAuditQueueTimeout,
+		queue:     make(chan *AuditEvent, auditQueueSize),
+		done:      make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+// SetQueueTimeout sets how long Emit waits for room in a full queue before dropping the event.
+// 0 drops at once, so Emit never blocks. Set it before the sink is in use.
+func (s *PublisherAuditSink) SetQueueTimeout(timeout time.Duration) {
+	s.timeout = timeout
+}
+
+// Emit queues event. When the queue is full it waits up to the queue timeout, or until ctx is done,
+// then drops the event and returns ErrAuditQueueFull.
+func (s *PublisherAuditSink) Emit(ctx context.Context, event *AuditEvent) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		s.dropped.Add(1)
+		return errors.New("audit sink closed")
+	}
+
+	select {
+	case s.queue <- event:
+		return nil
+	default:
+	}
+
+	if s.timeout > 0 {
+		timer := time.NewTimer(s.timeout)
+		defer timer.Stop()
+
+		select {
+		case s.queue <- event:
+			return nil
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+
+	s.dropped.Add(1)
+	return ErrAuditQueueFull
+}
+
+// Dropped returns the number of events dropped because the queue was full or the sink closed
+func (s *PublisherAuditSink) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Failed returns the number of events Pub/Sub did not accept
+func (s *PublisherAuditSink) Failed() uint64 {
+	return s.failed.Load()
+}
+
+// Close stops accepting events and waits until the queued ones are published
+func (s *PublisherAuditSink) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+}
+
+// run publishes queued events until Close
+func (s *PublisherAuditSink) run() {
+	defer close(s.done)
+
+	for event := range s.queue {
+		if err := s.publish(event); err != nil {
+			s.failed.Add(1)
+			log.Printf("failed to publish audit event %v. %v", event.Type, err)
+		}
+	}
+}
+
+// publish
+func (s *PublisherAuditSink) publish(event *AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	attrs := map[string]string{
+		"type":    event.Type,
+		"outcome": event.Outcome,
+	}
+	if event.Tenant != "" {
+		attrs["tenant"] = event.Tenant
+	}
+
+	return s.publisher.PublishMessage(s.topic, data, attrs)
+}
+
+// JSONLinesAuditSink writes each audit event as one line of JSON, e.g. to os.Stdout where Cloud
+// Logging picks it up as a structured entry
+type JSONLinesAuditSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONLinesAuditSink writes to w
+func NewJSONLinesAuditSink(w io.Writer) *JSONLinesAuditSink {
+	return &JSONLinesAuditSink{
+		enc: json.NewEncoder(w),
+	}
+}
+
+// Emit
+func (s *JSONLinesAuditSink) Emit(ctx context.Context, event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.enc.Encode(event)
+}
+
+// MemoryAuditSink keeps audit events in memory, for tests
+type MemoryAuditSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+// NewMemoryAuditSink
+func NewMemoryAuditSink() *MemoryAuditSink {
+	return &MemoryAuditSink{}
+}
+
+// Emit
+func (s *MemoryAuditSink) Emit(ctx context.Context, event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, *event)
+
+	return nil
+}
+
+// Events returns a copy of the events emitted so far, oldest first
+func (s *MemoryAuditSink) Events() []AuditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := make([]AuditEvent, len(s.events))
+	copy(events, s.events)
+
+	return events
+}
+
+// Reset discards the events
+func (s *MemoryAuditSink) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = nil
+}
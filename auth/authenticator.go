@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// Authenticator is the account and token method set of FirebaseAuth. Depend on it instead of
+// *FirebaseAuth to swap in FakeAuth in tests.
+type Authenticator interface {
+	Login(email string, password string) (*FBLoginResp, error)
+	LoginContext(ctx context.Context, email string, password string) (*FBLoginResp, error)
+	RefreshToken(refreshToken string) (*FBRefreshTokenResp, error)
+	RefreshTokenContext(ctx context.Context, refreshToken string) (*FBRefreshTokenResp, error)
+
+	CreateUser(email string, phone string, pwd string, name string, avatar string, verified bool, disabled bool) (string, error)
+	CreateUserContext(ctx context.Context, email string, phone string, pwd string, name string, avatar string, verified bool, disabled bool) (string, error)
+	UpdateUser(uid string, email string, pwd string, name string, avatar string, phone string, verified bool, disabled bool) error
+	UpdateUserContext(ctx context.Context, uid string, email string, pwd string, name string, avatar string, phone string, verified bool, disabled bool) error
+	UpdateUserFields(ctx context.Context, uid string, update *UserUpdate) (*auth.UserRecord, error)
+	UpdateUserEmail(uid string, email string) error
+	UpdateUserEmailContext(ctx context.Context, uid string, email string) error
+	UpdateUserPassword(uid string, password string) error
+	UpdateUserPasswordContext(ctx context.Context, uid string, password string) error
+	UpdateUserDisabled(uid string, disabled bool) error
+	UpdateUserDisabledContext(ctx context.Context, uid string, disabled bool) error
+	CheckUserExists(email string) (bool, error)
+	CheckUserExistsContext(ctx context.Context, email string) (bool, error)
+	ResetPasswordLink(email string) (string, error)
+	ResetPasswordLinkContext(ctx context.Context, email string) (string, error)
+
+	VerifyToken(idToken string) (*auth.Token, error)
+	VerifyTokenContext(ctx context.Context, idToken string) (*auth.Token, error)
+	CreateToken(uid string, claims map[string]interface{}) (string, error)
+	CreateTokenContext(ctx context.Context, uid string, claims map[string]interface{}) (string, error)
+	GetRoleFromToken(idToken string) (string, error)
+	GetRoleFromTokenContext(ctx context.Context, idToken string) (string, error)
+}
+
+var (
+	_ Authenticator = (*FirebaseAuth)(nil)
+	_ Authenticator = (*FakeAuth)(nil)
+)
@@ -0,0 +1,461 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Blocking function event types
+const (
+	BlockingBeforeCreate = "beforeCreate"
+	BlockingBeforeSignIn = "beforeSignIn"
+)
+
+const (
+	blockingEventTypePrefix = "providers/cloud.auth/eventTypes/user."
+
+	// maxBlockingClaimsSize is the limit Identity Platform puts on the encoded custom and session claims
+	maxBlockingClaimsSize = 1000
+)
+
+// ErrBlocked matches every *BlockingError
+var ErrBlocked = errors.New("blocked by blocking function")
+
+// reservedClaims may not be set by a blocking function or in imported custom claims
+var reservedClaims = map[string]struct{}{
+	"acr": {}, "amr": {}, "at_hash": {}, "aud": {}, "auth_time": {}, "azp": {}, "cnf": {}, "c_hash": {},
+	"exp": {}, "iat": {}, "iss": {}, "jti": {}, "nbf": {}, "nonce": {}, "firebase": {}, "sub": {},
+}
+
+// BlockingUserInfo is a provider linked to the user
+type BlockingUserInfo struct {
+	UID         string `json:"uid"`
+	ProviderID  string `json:"provider_id"`
+	Email       string `json:"email,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	PhotoURL    string `json:"photo_url,omitempty"`
+	PhoneNumber string `json:"phone_number,omitempty"`
+}
+
+// BlockingUserMetadata holds the account timestamps in milliseconds since the epoch
+type BlockingUserMetadata struct {
+	CreationTime   int64 `json:"creation_time,omitempty"`
+	LastSignInTime int64 `json:"last_sign_in_time,omitempty"`
+}
+
+// BlockingUser is the account being created or signed in, as it will be stored if the event is allowed
+type BlockingUser struct {
+	UID           string                 `json:"uid"`
+	Email         string                 `json:"email,omitempty"`
+	EmailVerified bool                   `json:"email_verified,omitempty"`
+	DisplayName   string                 `json:"display_name,omitempty"`
+	PhotoURL      string                 `json:"photo_url,omitempty"`
+	PhoneNumber   string                 `json:"phone_number,omitempty"`
+	Disabled      bool                   `json:"disabled,omitempty"`
+	Metadata      BlockingUserMetadata   `json:"metadata"`
+	ProviderData  []BlockingUserInfo     `json:"provider_data,omitempty"`
+	CustomClaims  map[string]interface{} `json:"custom_claims,omitempty"`
+	TenantID      string                 `json:"tenant_id,omitempty"`
+}
+
+// BlockingCredential holds the federated provider's tokens, when the provider is configured to pass them on
+type BlockingCredential struct {
+	IDToken      string `json:"oauth_id_token,omitempty"`
+	AccessToken  string `json:"oauth_access_token,omitempty"`
+	RefreshToken string `json:"oauth_refresh_token,omitempty"`
+	TokenSecret  string `json:"oauth_token_secret,omitempty"`
+	ExpiresIn    int64  `json:"oauth_expires_in,omitempty"` // seconds
+}
+
+// BlockingEvent is the verified payload of a blocking function call
+type BlockingEvent struct {
+	Type         string // BlockingBeforeCreate or BlockingBeforeSignIn
+	EventID      string
+	Time         time.Time
+	IPAddress    string
+	UserAgent    string
+	Locale       string
+	TenantID     string
+	SignInMethod string // e.g. ProviderPassword, ProviderGoogle or "emailLink"
+	User         BlockingUser
+
+	// Profile is the raw user info returned by a federated provider
+	Profile    map[string]interface{}
+	Credential *BlockingCredential
+
+	// Claims is the full JWT payload
+	Claims map[string]interface{}
+}
+
+// IsNewUser reports whether the event is for an account being created
+func (e *BlockingEvent) IsNewUser() bool {
+	return e.Type == BlockingBeforeCreate
+}
+
+// EmailDomain returns the lower-cased domain of the user's email, or ""
+func (e *BlockingEvent) EmailDomain() string {
+	_, domain, _ := strings.Cut(e.User.Email, "@")
+	return strings.ToLower(domain)
+}
+
+// BlockingResponse changes the account before it is stored. Nil fields are left untouched.
+type BlockingResponse struct {
+	DisplayName   *string
+	PhotoURL      *string
+	EmailVerified *bool
+	Disabled      *bool
+
+	// CustomClaims replaces the custom claims stored on the account
+	CustomClaims map[string]interface{}
+	// SessionClaims are added to the ID token of this sign-in only. beforeSignIn only.
+	SessionClaims map[string]interface{}
+}
+
+// BlockingFunc handles a blocking event. Return nil, nil to allow it unchanged, a response to
+// change the account, or Block to reject it. Other errors reject it with an internal error.
+type BlockingFunc func(ctx context.Context, event *BlockingEvent) (*BlockingResponse, error)
+
+// BlockingError rejects a blocking event. Message is shown to the user by the client SDK.
+type BlockingError struct {
+	StatusCode int    // HTTP status, e.g. http.StatusForbidden
+	Status     string // canonical status, e.g. "PERMISSION_DENIED"
+	Message    string
+}
+
+func (e *BlockingError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrBlocked, e.Message)
+}
+
+// Is matches ErrBlocked
+func (e *BlockingError) Is(target error) bool {
+	return target == ErrBlocked
+}
+
+// Block returns an error that rejects the event with message
+func Block(message string) error {
+	return &BlockingError{
+		StatusCode: http.StatusForbidden,
+		Status:     "PERMISSION_DENIED",
+		Message:    message,
+	}
+}
+
+// BlockingHandler serves Identity Platform blocking functions. It verifies the event JWT and
+// dispatches to the callback registered for the event type. Register the same handler for
+// both triggers, or one handler per trigger.
+type BlockingHandler struct {
+	projectID    string
+	tenantID     string
+	audience     string
+	keys         KeySource
+	skew         time.Duration
+	now          func() time.Time
+	beforeCreate BlockingFunc
+	beforeSignIn BlockingFunc
+}
+
+// NewBlockingHandler verifies events for projectID signed with keys. The token audience must contain
+// audience, e.g. the service URL or "run.app", matching the check the Admin SDK makes. An empty
+// audience accepts any.
+func NewBlockingHandler(projectID string, audience string, keys KeySource) *BlockingHandler {
+	return &BlockingHandler{
+		projectID: projectID,
+		audience:  audience,
+		keys:      keys,
+		skew:      defaultClockSkew,
+		now:       time.Now,
+	}
+}
+
+// NewBlockingHandler creates a BlockingHandler for f's project and tenant. Events are verified with
+// the keys of a LocalVerifier set through WithTokenVerifier, or Google's published certificates.
+func (f *FirebaseAuth) NewBlockingHandler(audience string) (*BlockingHandler, error) {
+	if f.projectID == "" {
+		return nil, errors.New("blocking handler needs a project ID, set it with WithFirebaseConfig")
+	}
+
+	var h *BlockingHandler
+	if v, ok := f.verifier.(*LocalVerifier); ok {
+		h = NewBlockingHandler(f.projectID, audience, v.keys)
+		h.now = v.now
+	} else {
+		h = NewBlockingHandler(f.projectID, audience, NewRemoteKeys(SecureTokenCertsURL, f.httpClient))
+	}
+	h.tenantID = f.tenantID
+
+	return h, nil
+}
+
+// SetClock replaces time.Now, for tests
+func (h *BlockingHandler) SetClock(now func() time.Time) {
+	h.now = now
+}
+
+// BeforeCreate registers fn for beforeCreate events
+func (h *BlockingHandler) BeforeCreate(fn BlockingFunc) *BlockingHandler {
+	h.beforeCreate = fn
+	return h
+}
+
+// BeforeSignIn registers fn for beforeSignIn events
+func (h *BlockingHandler) BeforeSignIn(fn BlockingFunc) *BlockingHandler {
+	h.beforeSignIn = fn
+	return h
+}
+
+// ServeHTTP
+func (h *BlockingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeBlockingError(w, &BlockingError{http.StatusMethodNotAllowed, "INVALID_ARGUMENT", "method not allowed"})
+		return
+	}
+
+	var req struct {
+		Data struct {
+			JWT string `json:"jwt"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Data.JWT == "" {
+		writeBlockingError(w, &BlockingError{http.StatusBadRequest, "INVALID_ARGUMENT", "bad request"})
+		return
+	}
+
+	event, err := h.VerifyEvent(r.Context(), req.Data.JWT)
+	if err != nil {
+		writeBlockingError(w, &BlockingError{http.StatusUnauthorized, "UNAUTHENTICATED", err.Error()})
+		return
+	}
+
+	var fn BlockingFunc
+	switch event.Type {
+	case BlockingBeforeCreate:
+		fn = h.beforeCreate
+	case BlockingBeforeSignIn:
+		fn = h.beforeSignIn
+	}
+
+	var resp *BlockingResponse
+	if fn != nil {
+		resp, err = fn(r.Context(), event)
+	}
+
+	var body interface{}
+	if err == nil {
+		body, err = encodeBlockingResponse(event.Type, resp)
+	}
+
+	if err != nil {
+		var blockErr *BlockingError
+		if !errors.As(err, &blockErr) {
+			log.Printf("blocking function %v failed for event %v. %v", event.Type, event.EventID, err)
+			blockErr = &BlockingError{http.StatusInternalServerError, "INTERNAL", "an unexpected error occurred"}
+		}
+
+		writeBlockingError(w, blockErr)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// blockingPayload is the JWT payload of a blocking event
+type blockingPayload struct {
+	EventID      string        `json:"event_id"`
+	EventType    string        `json:"event_type"`
+	IPAddress    string        `json:"ip_address"`
+	UserAgent    string        `json:"user_agent"`
+	Locale       string        `json:"locale"`
+	TenantID     string        `json:"tenant_id"`
+	SignInMethod string        `json:"sign_in_method"`
+	RawUserInfo  string        `json:"raw_user_info"`
+	UserRecord   *BlockingUser `json:"user_record"`
+	BlockingCredential
+}
+
+// VerifyEvent verifies the signature, issuer, audience, expiry and tenant of an event JWT and decodes it
+func (h *BlockingHandler) VerifyEvent(ctx context.Context, token string) (*BlockingEvent, error) {
+	t, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := h.keys.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.verifyWithKeys(keys); err != nil {
+		return nil, err
+	}
+
+	if iss := t.str("iss"); iss != firebaseIssuerPrefix+h.projectID {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, iss)
+	}
+	if h.audience != "" && !audienceContains(t, h.audience) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+	if err = t.checkTimes(h.now(), h.skew); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(t.claims)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload blockingPayload
+	if err = json.Unmarshal(data, &payload); err != nil {
+		return nil, fmt.Errorf("%w: invalid blocking event: %v", ErrInvalidToken, err)
+	}
+
+	event := &BlockingEvent{
+		EventID:      payload.EventID,
+		Time:         t.time("iat"),
+		IPAddress:    payload.IPAddress,
+		UserAgent:    payload.UserAgent,
+		Locale:       payload.Locale,
+		TenantID:     payload.TenantID,
+		SignInMethod: payload.SignInMethod,
+		Claims:       t.claims,
+	}
+
+	// e.g. providers/cloud.auth/eventTypes/user.beforeCreate:password
+	eventType, method, _ := strings.Cut(strings.TrimPrefix(payload.EventType, blockingEventTypePrefix), ":")
+	if eventType != BlockingBeforeCreate && eventType != BlockingBeforeSignIn {
+		return nil, fmt.Errorf("%w: unsupported event type %q", ErrInvalidToken, payload.EventType)
+	}
+	event.Type = eventType
+	if event.SignInMethod == "" {
+		event.SignInMethod = method
+	}
+
+	if h.tenantID != "" && event.TenantID != h.tenantID {
+		return nil, ErrTenantMismatch
+	}
+
+	if payload.UserRecord != nil {
+		event.User = *payload.UserRecord
+	}
+
+	if payload.RawUserInfo != "" {
+		if err = json.Unmarshal([]byte(payload.RawUserInfo), &event.Profile); err != nil {
+			return nil, fmt.Errorf("%w: invalid raw_user_info: %v", ErrInvalidToken, err)
+		}
+	}
+
+	if payload.BlockingCredential != (BlockingCredential{}) {
+		credential := payload.BlockingCredential
+		event.Credential = &credential
+	}
+
+	return event, nil
+}
+
+// audienceContains reports whether any audience of t contains s
+func audienceContains(t *jwt, s string) bool {
+	switch aud := t.claims["aud"].(type) {
+	case string:
+		return strings.Contains(aud, s)
+	case []interface{}:
+		for _, a := range aud {
+			if str, ok := a.(string); ok && strings.Contains(str, s) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// encodeBlockingResponse builds the userRecord update Identity Platform expects
+func encodeBlockingResponse(eventType string, resp *BlockingResponse) (interface{}, error) {
+	if resp == nil {
+		return struct{}{}, nil
+	}
+
+	record := map[string]interface{}{}
+	var mask []string
+
+	set := func(name string, value interface{}) {
+		record[name] = value
+		mask = append(mask, name)
+	}
+
+	if resp.DisplayName != nil {
+		set("displayName", *resp.DisplayName)
+	}
+	if resp.PhotoURL != nil {
+		set("photoURL", *resp.PhotoURL)
+	}
+	if resp.EmailVerified != nil {
+		set("emailVerified", *resp.EmailVerified)
+	}
+	if resp.Disabled != nil {
+		set("disabled", *resp.Disabled)
+	}
+	if resp.CustomClaims != nil {
+		if err := checkBlockingClaims("custom", resp.CustomClaims); err != nil {
+			return nil, err
+		}
+		set("customClaims", resp.CustomClaims)
+	}
+	if resp.SessionClaims != nil {
+		if eventType != BlockingBeforeSignIn {
+			return nil, errors.New("session claims can only be set in beforeSignIn")
+		}
+		if err := checkBlockingClaims("session", resp.SessionClaims); err != nil {
+			return nil, err
+		}
+		set("sessionClaims", resp.SessionClaims)
+	}
+
+	if len(mask) == 0 {
+		return struct{}{}, nil
+	}
+
+	record["updateMask"] = strings.Join(mask, ",")
+
+	return map[string]interface{}{"userRecord": record}, nil
+}
+
+// checkBlockingClaims rejects reserved and oversized claims before Identity Platform does
+func checkBlockingClaims(kind string, claims map[string]interface{}) error {
+	for k := range claims {
+		if _, ok := reservedClaims[k]; ok {
+			return fmt.Errorf("%v claim %q is reserved", kind, k)
+		}
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxBlockingClaimsSize {
+		return fmt.Errorf("%v claims exceed %d bytes", kind, maxBlockingClaimsSize)
+	}
+
+	return nil
+}
+
+// writeBlockingError
+func writeBlockingError(w http.ResponseWriter, e *BlockingError) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(e.StatusCode)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{
+			"status":  e.Status,
+			"message": e.Message,
+		},
+	})
+}
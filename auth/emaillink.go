@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// EmailSignInLink generates a passwordless sign-in link for email without sending it, e.g. to deliver
+// it with our own mail templates. settings.URL is where the user lands; HandleCodeInApp must be true
+// for sign-in links.
+func (f *FirebaseAuth) EmailSignInLink(ctx context.Context, email string, settings *auth.ActionCodeSettings) (string, error) {
+	return f.client.EmailSignInLink(ctx, email, settings)
+}
+
+// SendSignInLinkEmail has Firebase email a passwordless sign-in link to email
+func (f *FirebaseAuth) SendSignInLinkEmail(ctx context.Context, email string, settings *auth.ActionCodeSettings) error {
+	if settings == nil || settings.URL == "" {
+		return errors.New("action code settings must have a continue URL")
+	}
+
+	req := map[string]interface{}{
+		"requestType":        OobEmailSignIn,
+		"email":              email,
+		"continueUrl":        settings.URL,
+		"canHandleCodeInApp": settings.HandleCodeInApp,
+	}
+	if settings.DynamicLinkDomain != "" {
+		req["dynamicLinkDomain"] = settings.DynamicLinkDomain
+	}
+	if settings.IOSBundleID != "" {
+		req["iOSBundleId"] = settings.IOSBundleID
+	}
+	if settings.AndroidPackageName != "" {
+		req["androidPackageName"] = settings.AndroidPackageName
+		req["androidInstallApp"] = settings.AndroidInstallApp
+		req["androidMinimumVersion"] = settings.AndroidMinimumVersion
+	}
+
+	return f.postJSON(ctx, "/accounts:sendOobCode", req, nil)
+}
+
+// SignInWithEmailLink completes a passwordless sign-in. link is the full link the user followed,
+// or just its oobCode, and email must be the address the link was sent to.
+// The account is created on first sign-in.
+func (f *FirebaseAuth) SignInWithEmailLink(ctx context.Context, email string, link string) (*FBLoginResp, error) {
+	oobCode, err := OobCodeFromLink(link)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp FBLoginResp
+
+	err = f.postJSON(ctx, "/accounts:signInWithEmailLink", map[string]interface{}{
+		"email":             email,
+		"oobCode":           oobCode,
+		"returnSecureToken": true,
+	}, &resp)
+	f.audit(ctx, &AuditEvent{Type: AuditLogin, UID: resp.UID, Details: map[string]interface{}{"email": email, "method": "email_link"}}, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// IsSignInWithEmailLink reports whether link is an email sign-in link
+func IsSignInWithEmailLink(link string) bool {
+	params, ok := actionLinkParams(link)
+	return ok && params.Get("mode") == "signIn" && params.Get("oobCode") != ""
+}
+
+// OobCodeFromLink extracts the oobCode from an email action link, including links wrapped by
+// Firebase Dynamic Links. A value that is not a URL is returned as is.
+func OobCodeFromLink(link string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme == "" {
+		if link == "" {
+			return "", fmt.Errorf("%w: empty link", ErrInvalidOOBCode)
+		}
+		return link, nil
+	}
+
+	params, ok := actionLinkParams(link)
+	if !ok || params.Get("oobCode") == "" {
+		return "", fmt.Errorf("%w: link has no oobCode", ErrInvalidOOBCode)
+	}
+
+	return params.Get("oobCode"), nil
+}
+
+// actionLinkParams returns the query of the action link, unwrapping the link and deep_link_id
+// parameters that dynamic links use to carry the original
+func actionLinkParams(link string) (url.Values, bool) {
+	for i := 0; i < 3; i++ {
+		u, err := url.Parse(link)
+		if err != nil {
+			return nil, false
+		}
+
+		q := u.Query()
+		if q.Get("oobCode") != "" {
+			return q, true
+		}
+
+		switch {
+		case q.Get("link") != "":
+			link = q.Get("link")
+		case q.Get("deep_link_id") != "":
+			link = q.Get("deep_link_id")
+		default:
+			return q, true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,510 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+	"github.com/vrus/gcp-golib/storage"
+)
+
+// uidPlaceholder is replaced with the UID in object prefixes and key patterns
+const uidPlaceholder = "{uid}"
+
+// Erasure step statuses
+const (
+	StepPlanned = "planned" // dry run
+	StepDone    = "done"
+	StepFailed  = "failed"
+)
+
+// AuditUserErased is emitted when an erasure completes
+const AuditUserErased = "account.erased"
+
+// UserDeleter deletes accounts, e.g. *FirebaseAuth
+type UserDeleter interface {
+	DeleteUser(ctx context.Context, uid string) error
+}
+
+// ObjectStore is the subset of storage.FileStore used for erasure
+type ObjectStore interface {
+	ListFiles(bucket string, prefix string) ([]string, error)
+	DeleteFile(bucket string, filename string) error
+}
+
+// KeyScanner is the subset of storage.MemStore used for erasure
+type KeyScanner interface {
+	ScanKeys(pattern string) ([]string, error)
+	DeleteKey(key string) bool
+}
+
+var (
+	_ UserDeleter = (*FirebaseAuth)(nil)
+	_ UserDeleter = (*FakeAuth)(nil)
+	_ ObjectStore = (*storage.FileStore)(nil)
+	_ KeyScanner  = (*storage.MemStore)(nil)
+)
+
+// ObjectPrefix locates a user's objects. Prefix contains {uid} followed by "/" or ":", e.g. "users/{uid}/",
+// so it cannot match the objects of another user whose UID starts with the same characters. UIDs
+// containing a delimiter that follows {uid} in any template cannot be erased, see Eraser.Erase.
+type ObjectPrefix struct {
+	Bucket string
+	Prefix string
+}
+
+// ErasureConfig configures an Eraser. Every source is optional.
+//
+// The characters following {uid} in the templates must not appear in any UID: with "session:{uid}:*"
+// the keys of a user "abc:def" would also match "abc". Erase refuses such UIDs, so keep custom UIDs
+// free of them, or pick templates whose delimiters the UIDs never contain.
+type ErasureConfig struct {
+	Users UserDeleter
+
+	Files   ObjectStore
+	Objects []ObjectPrefix
+
+	Keys        KeyScanner
+	KeyPatterns []string // glob patterns containing {uid} followed by "/", ":" or the end, e.g. "session:{uid}:*"
+
+	// APIKeys revokes the API keys the user owns
+	APIKeys *APIKeyManager
+
+	// Checkpoints keeps the progress of interrupted erasures so Erase resumes where it stopped.
+	// Without it a retry starts over, which is safe but repeats the completed steps.
+	Checkpoints Store
+	KeyPrefix   string // Checkpoints key prefix, default "erasure:"
+
+	// SigningKey signs the reports with HMAC-SHA256. Required.
+	SigningKey []byte
+
+	// Audit receives AuditUserErased, by default the audit sink of Users when it is a *FirebaseAuth
+	Audit AuditSink
+}
+
+// ErasureStep is the outcome of one source
+type ErasureStep struct {
+	Name   string   `json:"name"` // e.g. "auth", "gs://bucket/users/uid/" or "redis:session:uid:*"
+	Status string   `json:"status"`
+	Count  int      `json:"count"`           // items deleted, or to be deleted in a dry run
+	Items  []string `json:"items,omitempty"` // dry run only
+	Error  string   `json:"error,omitempty"`
+}
+
+// ErasureReport records an erasure. Keep completed reports as evidence; Verify proves they
+// were produced with the signing key and not altered.
+type ErasureReport struct {
+	UID         string        `json:"uid"`
+	DryRun      bool          `json:"dry_run"`
+	StartedAt   time.Time     `json:"started_at"`
+	CompletedAt time.Time     `json:"completed_at,omitempty"`
+	Steps       []ErasureStep `json:"steps"`
+	Signature   string        `json:"signature,omitempty"`
+}
+
+// Eraser deletes everything held about a user across Firebase Auth, API keys, Cloud Storage and Redis
+type Eraser struct {
+	cfg        ErasureConfig
+	delimiters string // the characters following {uid} in the templates
+	audit      func(ctx context.Context, event *AuditEvent, err error)
+	now        func() time.Time
+}
+
+// NewEraser checks that every prefix and pattern is scoped to the user
+func NewEraser(cfg ErasureConfig) (*Eraser, error) {
+	if len(cfg.SigningKey) == 0 {
+		return nil, errors.New("eraser needs a signing key")
+	}
+	if len(cfg.Objects) > 0 && cfg.Files == nil {
+		return nil, errors.New("eraser has object prefixes but no object store")
+	}
+	if len(cfg.KeyPatterns) > 0 && cfg.Keys == nil {
+		return nil, errors.New("eraser has key patterns but no key store")
+	}
+
+	for _, o := range cfg.Objects {
+		if !uidDelimited(o.Prefix, false) {
+			return nil, fmt.Errorf("object prefix %q must contain %v followed by / or :", o.Prefix, uidPlaceholder)
+		}
+	}
+	for _, p := range cfg.KeyPatterns {
+		if !uidDelimited(p, true) {
+			return nil, fmt.Errorf("key pattern %q must contain %v followed by /, : or the end", p, uidPlaceholder)
+		}
+	}
+
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = "erasure:"
+	}
+
+	e := &Eraser{
+		cfg: cfg,
+		now: time.Now,
+	}
+
+	for _, o := range cfg.Objects {
+		e.addDelimiters(o.Prefix)
+	}
+	for _, p := range cfg.KeyPatterns {
+		e.addDelimiters(p)
+	}
+
+	// completed erasures go to the account's audit sink, if there is one
+	if cfg.Audit != nil {
+		e.audit = func(ctx context.Context, event *AuditEvent, err error) {
+			emitAudit(ctx, cfg.Audit, "", event, err)
+		}
+	} else if f, ok := cfg.Users.(*FirebaseAuth); ok {
+		e.audit = f.audit
+	}
+
+	return e, nil
+}
+
+// uidDelimited reports whether template contains {uid} and every {uid} ends at a delimiter. A
+// prefix or glob that continues after the UID would also match users whose UID starts with it.
+func uidDelimited(template string, endOK bool) bool {
+	parts := strings.Split(template, uidPlaceholder)
+	if len(parts) < 2 {
+		return false
+	}
+
+	for _, rest := range parts[1:] {
+		if rest == "" {
+			if !endOK {
+				return false
+			}
+			continue
+		}
+		if rest[0] != '/' && rest[0] != ':' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// addDelimiters records the characters following {uid} in template
+func (e *Eraser) addDelimiters(template string) {
+	for _, rest := range strings.Split(template, uidPlaceholder)[1:] {
+		if rest != "" && !strings.ContainsRune(e.delimiters, rune(rest[0])) {
+			e.delimiters += rest[:1]
+		}
+	}
+}
+
+// escapeGlob escapes the Redis glob metacharacters in s, so a UID only ever matches itself
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// SetClock replaces time.Now, for tests
+func (e *Eraser) SetClock(now func() time.Time) {
+	e.now = now
+}
+
+// Plan lists what Erase would delete without deleting anything
+func (e *Eraser) Plan(ctx context.Context, uid string) (*ErasureReport, error) {
+	return e.run(ctx, uid, true)
+}
+
+// Erase deletes the account, then revokes the API keys, then deletes the objects, then the keys.
+// A UID containing a delimiter that follows {uid} in the templates is refused: with "session:{uid}:*"
+// the keys of "abc:def" would also match "abc", so neither could be told apart. On failure the partial report is
+// returned with the error; calling Erase again resumes from the failed step.
+func (e *Eraser) Erase(ctx context.Context, uid string) (*ErasureReport, error) {
+	return e.run(ctx, uid, false)
+}
+
+// run
+func (e *Eraser) run(ctx context.Context, uid string, dryRun bool) (*ErasureReport, error) {
+	if uid == "" {
+		return nil, errors.New("erasure needs a uid")
+	}
+	if strings.ContainsAny(uid, e.delimiters) {
+		return nil, fmt.Errorf("uid %q contains a delimiter of the erasure templates %q", uid, e.delimiters)
+	}
+
+	report := &ErasureReport{UID: uid, DryRun: dryRun, StartedAt: e.now().UTC()}
+	if !dryRun {
+		if err := e.loadCheckpoint(uid, report); err != nil {
+			return nil, err
+		}
+	}
+
+	type step struct {
+		name string
+		run  func() (int, []string, error)
+	}
+
+	var steps []step
+	if e.cfg.Users != nil {
+		steps = append(steps, step{"auth", func() (int, []string, error) {
+			return e.eraseUser(ctx, uid, dryRun)
+		}})
+	}
+	if e.cfg.APIKeys != nil {
+		steps = append(steps, step{"apikeys", func() (int, []string, error) {
+			return e.eraseAPIKeys(ctx, uid, dryRun)
+		}})
+	}
+	for _, o := range e.cfg.Objects {
+		bucket, prefix := o.Bucket, strings.ReplaceAll(o.Prefix, uidPlaceholder, uid)
+		steps = append(steps, step{"gs://" + bucket + "/" + prefix, func() (int, []string, error) {
+			return e.eraseObjects(bucket, prefix, dryRun)
+		}})
+	}
+	for _, p := range e.cfg.KeyPatterns {
+		pattern := strings.ReplaceAll(p, uidPlaceholder, escapeGlob(uid))
+		steps = append(steps, step{"redis:" + pattern, func() (int, []string, error) {
+			return e.eraseKeys(pattern, dryRun)
+		}})
+	}
+
+	for _, s := range steps {
+		if report.done(s.name) {
+			continue
+		}
+
+		count, items, err := s.run()
+
+		result := ErasureStep{Name: s.name, Status: StepDone, Count: count}
+		if dryRun {
+			result.Status = StepPlanned
+			result.Items = items
+		}
+		if err != nil {
+			result.Status = StepFailed
+			result.Error = err.Error()
+		}
+		report.set(result)
+
+		if err != nil {
+			if !dryRun {
+				if cpErr := e.saveCheckpoint(report); cpErr != nil {
+					err = fmt.Errorf("%w (checkpoint not saved: %v)", err, cpErr)
+				}
+			}
+			return report, fmt.Errorf("erasure step %v failed: %w", s.name, err)
+		}
+
+		if !dryRun {
+			if err = e.saveCheckpoint(report); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	report.CompletedAt = e.now().UTC()
+	if err := report.sign(e.cfg.SigningKey); err != nil {
+		return nil, err
+	}
+
+	if !dryRun {
+		if e.cfg.Checkpoints != nil {
+			e.cfg.Checkpoints.DeleteKey(e.cfg.KeyPrefix + uid)
+		}
+		if e.audit != nil {
+			e.audit(ctx, &AuditEvent{Type: AuditUserErased, UID: uid}, nil)
+		}
+	}
+
+	return report, nil
+}
+
+// eraseUser deletes the account. An account that no longer exists counts as deleted.
+func (e *Eraser) eraseUser(ctx context.Context, uid string, dryRun bool) (int, []string, error) {
+	if dryRun {
+		return 1, []string{uid}, nil
+	}
+
+	if err := e.cfg.Users.DeleteUser(ctx, uid); err != nil {
+		if auth.IsUserNotFound(err) || errors.Is(err, ErrUserNotFound) {
+			return 0, nil, nil
+		}
+		return 0, nil, err
+	}
+
+	return 1, nil, nil
+}
+
+// eraseAPIKeys revokes the keys the user owns
+func (e *Eraser) eraseAPIKeys(ctx context.Context, uid string, dryRun bool) (int, []string, error) {
+	if dryRun {
+		keys, err := e.cfg.APIKeys.List(ctx, uid)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		ids := make([]string, 0, len(keys))
+		for _, key := range keys {
+			ids = append(ids, key.ID)
+		}
+		return len(ids), ids, nil
+	}
+
+	count, err := e.cfg.APIKeys.RevokeAll(ctx, uid)
+	return count, nil, err
+}
+
+// eraseObjects deletes the objects under prefix. A retry lists again, so it only sees what is left.
+func (e *Eraser) eraseObjects(bucket string, prefix string, dryRun bool) (int, []string, error) {
+	names, err := e.cfg.Files.ListFiles(bucket, prefix)
+	if err != nil {
+		return 0, nil, err
+	}
+	if dryRun {
+		return len(names), names, nil
+	}
+
+	for i, name := range names {
+		if err = e.cfg.Files.DeleteFile(bucket, name); err != nil {
+			return i, nil, err
+		}
+	}
+
+	return len(names), nil, nil
+}
+
+// eraseKeys deletes the keys matching pattern
+func (e *Eraser) eraseKeys(pattern string, dryRun bool) (int, []string, error) {
+	keys, err := e.cfg.Keys.ScanKeys(pattern)
+	if err != nil {
+		return 0, nil, err
+	}
+	if dryRun {
+		return len(keys), keys, nil
+	}
+
+	count := 0
+	for _, key := range keys {
+		// false means the key expired or was deleted in the meantime
+		if e.cfg.Keys.DeleteKey(key) {
+			count++
+		}
+	}
+
+	return count, nil, nil
+}
+
+// loadCheckpoint resumes an interrupted erasure, keeping its start time and completed steps
+func (e *Eraser) loadCheckpoint(uid string, report *ErasureReport) error {
+	if e.cfg.Checkpoints == nil {
+		return nil
+	}
+
+	var saved ErasureReport
+	if err := e.cfg.Checkpoints.GetKey(e.cfg.KeyPrefix+uid, &saved); err != nil {
+		return err
+	}
+	if saved.UID != uid {
+		return nil
+	}
+
+	report.StartedAt = saved.StartedAt
+	for _, s := range saved.Steps {
+		if s.Status == StepDone {
+			report.Steps = append(report.Steps, s)
+		}
+	}
+
+	return nil
+}
+
+// saveCheckpoint
+func (e *Eraser) saveCheckpoint(report *ErasureReport) error {
+	if e.cfg.Checkpoints == nil {
+		return nil
+	}
+
+	if !e.cfg.Checkpoints.SaveKey(e.cfg.KeyPrefix+report.UID, report, 0) {
+		return fmt.Errorf("failed to save erasure checkpoint for %v", report.UID)
+	}
+
+	return nil
+}
+
+// done reports whether step name completed in an earlier run
+func (r *ErasureReport) done(name string) bool {
+	for _, s := range r.Steps {
+		if s.Name == name && s.Status == StepDone {
+			return true
+		}
+	}
+
+	return false
+}
+
+// set adds or replaces the result of a step
+func (r *ErasureReport) set(step ErasureStep) {
+	for i, s := range r.Steps {
+		if s.Name == step.Name {
+			r.Steps[i] = step
+			return
+		}
+	}
+
+	r.Steps = append(r.Steps, step)
+}
+
+// sign sets Signature to the HMAC of the report without it
+func (r *ErasureReport) sign(key []byte) error {
+	mac, err := r.mac(key)
+	if err != nil {
+		return err
+	}
+
+	r.Signature = base64.RawURLEncoding.EncodeToString(mac)
+
+	return nil
+}
+
+// Verify reports whether the report was signed with key and is unchanged
+func (r *ErasureReport) Verify(key []byte) bool {
+	sig, err := base64.RawURLEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return false
+	}
+
+	mac, err := r.mac(key)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(sig, mac)
+}
+
+// mac
+func (r *ErasureReport) mac(key []byte) ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = ""
+
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,352 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// memObjects is an in-memory ObjectStore. failDeletes makes that many DeleteFile calls fail.
+type memObjects struct {
+	objects     map[string]bool // bucket + "/" + name
+	failDeletes int
+}
+
+func newMemObjects(names ...string) *memObjects {
+	m := &memObjects{objects: make(map[string]bool)}
+	for _, name := range names {
+		m.objects["b/"+name] = true
+	}
+
+	return m
+}
+
+func (m *memObjects) ListFiles(bucket string, prefix string) ([]string, error) {
+	var names []string
+	for key := range m.objects {
+		if name, ok := strings.CutPrefix(key, bucket+"/"); ok && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (m *memObjects) DeleteFile(bucket string, filename string) error {
+	if m.failDeletes > 0 {
+		m.failDeletes--
+		return errors.New("storage unavailable")
+	}
+
+	delete(m.objects, bucket+"/"+filename)
+	return nil
+}
+
+type erasureFixture struct {
+	users   *FakeAuth
+	files   *memObjects
+	keys    *LocalStore
+	apiKeys *APIKeyManager
+	audit   *MemoryAuditSink
+	eraser  *Eraser
+}
+
+// newErasureFixture erases "users/{uid}/" objects and "session:{uid}:*" and "profile:{uid}" keys
+func newErasureFixture(t *testing.T) *erasureFixture {
+	t.Helper()
+
+	users, err := NewFakeAuth("test-project")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fx := &erasureFixture{
+		users: users,
+		files: newMemObjects(),
+		keys:  NewLocalStore(),
+		audit: NewMemoryAuditSink(),
+	}
+	fx.apiKeys = NewAPIKeyManager(fx.keys, APIKeyConfig{})
+
+	fx.eraser, err = NewEraser(ErasureConfig{
+		Users:       users,
+		Files:       fx.files,
+		Objects:     []ObjectPrefix{{Bucket: "b", Prefix: "users/{uid}/"}},
+		Keys:        fx.keys,
+		KeyPatterns: []string{"session:{uid}:*", "profile:{uid}"},
+		APIKeys:     fx.apiKeys,
+		Checkpoints: NewLocalStore(),
+		SigningKey:  []byte("test-signing-key"),
+		Audit:       fx.audit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fx
+}
+
+// addUser creates an account with objects and keys under its UID
+func (fx *erasureFixture) addUser(t *testing.T, email string) string {
+	t.Helper()
+
+	uid, err := fx.users.CreateUser(email, "", "secret-password", "Test User", "", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fx.addData(t, uid)
+
+	return uid
+}
+
+// addData stores two objects, two session keys and a profile key for uid
+func (fx *erasureFixture) addData(t *testing.T, uid string) {
+	t.Helper()
+
+	fx.files.objects["b/users/"+uid+"/a.png"] = true
+	fx.files.objects["b/users/"+uid+"/b/c.png"] = true
+
+	for _, key := range []string{"session:" + uid + ":1", "session:" + uid + ":2", "profile:" + uid} {
+		if !fx.keys.SaveKey(key, "value", 0) {
+			t.Fatalf("failed to save %v", key)
+		}
+	}
+}
+
+// dataOf lists the objects and keys left for uid
+func (fx *erasureFixture) dataOf(uid string) []string {
+	left, _ := fx.files.ListFiles("b", "users/"+uid+"/")
+
+	for _, pattern := range []string{"session:" + escapeGlob(uid) + ":*", "profile:" + escapeGlob(uid)} {
+		keys, _ := fx.keys.ScanKeys(pattern)
+		left = append(left, keys...)
+	}
+
+	return left
+}
+
+func TestNewEraserRejectsUndelimitedTemplates(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ErasureConfig
+	}{
+		{"prefix without uid", ErasureConfig{Files: newMemObjects(), Objects: []ObjectPrefix{{Bucket: "b", Prefix: "users/"}}}},
+		{"prefix ending in uid", ErasureConfig{Files: newMemObjects(), Objects: []ObjectPrefix{{Bucket: "b", Prefix: "users/{uid}"}}}},
+		{"prefix continuing after uid", ErasureConfig{Files: newMemObjects(), Objects: []ObjectPrefix{{Bucket: "b", Prefix: "users/{uid}-"}}}},
+		{"pattern with glob after uid", ErasureConfig{Keys: NewLocalStore(), KeyPatterns: []string{"session:{uid}*"}}},
+		{"second uid undelimited", ErasureConfig{Keys: NewLocalStore(), KeyPatterns: []string{"a:{uid}:b:{uid}x"}}},
+		{"no signing key", ErasureConfig{}},
+	}
+
+	for _, tt := range tests {
+		if tt.name != "no signing key" {
+			tt.cfg.SigningKey = []byte("k")
+		}
+		if _, err := NewEraser(tt.cfg); err == nil {
+			t.Errorf("%v: NewEraser accepted the config", tt.name)
+		}
+	}
+}
+
+func TestEraseLeavesUsersSharingAPrefix(t *testing.T) {
+	fx := newErasureFixture(t)
+	ctx := context.Background()
+
+	// custom UIDs, as imported or minted by a backend, where one is a prefix of the other
+	fx.addData(t, "abc")
+	fx.addData(t, "abcd")
+
+	otherKey, _, err := fx.apiKeys.Issue(ctx, "abcd", APIKeySpec{Name: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mine, _, err := fx.apiKeys.Issue(ctx, "abc", APIKeySpec{Name: "mine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = fx.eraser.Erase(ctx, "abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	if left := fx.dataOf("abc"); len(left) != 0 {
+		t.Errorf("erased user's data left: %v", left)
+	}
+	if left := fx.dataOf("abcd"); len(left) != 5 {
+		t.Errorf("other user's data deleted, left %v", left)
+	}
+	if _, err = fx.apiKeys.Verify(ctx, mine); !errors.Is(err, ErrUnknownAPIKey) {
+		t.Errorf("erased user's api key still verifies: %v", err)
+	}
+	if _, err = fx.apiKeys.Verify(ctx, otherKey); err != nil {
+		t.Errorf("other user's api key revoked: %v", err)
+	}
+}
+
+func TestEraseRefusesUIDsContainingATemplateDelimiter(t *testing.T) {
+	fx := newErasureFixture(t)
+	ctx := context.Background()
+
+	// the keys of "abc:def" would match "session:abc:*", so such UIDs are outside what the templates
+	// can tell apart and are refused before anything is listed or deleted
+	fx.addData(t, "abc:def")
+
+	if _, err := fx.eraser.Plan(ctx, "abc:def"); err == nil {
+		t.Fatal("Plan accepted a uid containing ':'")
+	}
+	if _, err := fx.eraser.Erase(ctx, "abc:def"); err == nil {
+		t.Fatal("Erase accepted a uid containing ':'")
+	}
+	if _, err := fx.eraser.Erase(ctx, "abc/def"); err == nil {
+		t.Fatal("Erase accepted a uid containing '/'")
+	}
+
+	if left := fx.dataOf("abc:def"); len(left) != 5 {
+		t.Errorf("refused erasure deleted data, left %v", left)
+	}
+}
+
+func TestEraseEscapesGlobCharactersInUID(t *testing.T) {
+	fx := newErasureFixture(t)
+	ctx := context.Background()
+
+	for _, uid := range []string{"a*", "a?", "a[b]", "ab"} {
+		fx.addData(t, uid)
+	}
+
+	for _, uid := range []string{"a*", "a?", "a[b]"} {
+		if _, err := fx.eraser.Erase(ctx, uid); err != nil {
+			t.Fatalf("erase %v: %v", uid, err)
+		}
+		if left := fx.dataOf(uid); len(left) != 0 {
+			t.Errorf("%v: data left %v", uid, left)
+		}
+	}
+
+	if left := fx.dataOf("ab"); len(left) != 5 {
+		t.Errorf("other user's data deleted, left %v", left)
+	}
+}
+
+func TestPlanMatchesErase(t *testing.T) {
+	fx := newErasureFixture(t)
+	ctx := context.Background()
+	uid := fx.addUser(t, "u@example.com")
+
+	if _, _, err := fx.apiKeys.Issue(ctx, uid, APIKeySpec{}); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := fx.eraser.Plan(ctx, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.DryRun {
+		t.Error("plan is not marked as a dry run")
+	}
+	if _, err = fx.users.GetUser(uid); err != nil {
+		t.Fatalf("plan deleted the account: %v", err)
+	}
+	if left := fx.dataOf(uid); len(left) != 5 {
+		t.Fatalf("plan deleted data, left %v", left)
+	}
+
+	report, err := fx.eraser.Erase(ctx, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plan.Steps) != len(report.Steps) {
+		t.Fatalf("plan has %d steps, erase %d", len(plan.Steps), len(report.Steps))
+	}
+	for i, step := range report.Steps {
+		planned := plan.Steps[i]
+		if step.Name != planned.Name || step.Count != planned.Count || len(planned.Items) != planned.Count {
+			t.Errorf("step %v: planned %+v, erased %+v", step.Name, planned, step)
+		}
+		if step.Status != StepDone || planned.Status != StepPlanned {
+			t.Errorf("step %v: statuses %v and %v", step.Name, planned.Status, step.Status)
+		}
+	}
+
+	if _, err = fx.users.GetUser(uid); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("account not deleted: %v", err)
+	}
+	if left := fx.dataOf(uid); len(left) != 0 {
+		t.Errorf("data left %v", left)
+	}
+}
+
+func TestEraseResumesFromCheckpoint(t *testing.T) {
+	fx := newErasureFixture(t)
+	ctx := context.Background()
+	uid := fx.addUser(t, "u@example.com")
+
+	fx.files.failDeletes = 1
+
+	partial, err := fx.eraser.Erase(ctx, uid)
+	if err == nil {
+		t.Fatal("erase succeeded with a failing object store")
+	}
+	if partial == nil || partial.Signature != "" {
+		t.Fatalf("partial report %+v should be returned unsigned", partial)
+	}
+	if events := fx.audit.Events(); len(events) != 0 {
+		t.Fatalf("audit events before completion: %+v", events)
+	}
+
+	report, err := fx.eraser.Erase(ctx, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !report.StartedAt.Equal(partial.StartedAt) {
+		t.Errorf("resumed erasure started at %v, first attempt at %v", report.StartedAt, partial.StartedAt)
+	}
+	for _, step := range report.Steps {
+		if step.Status != StepDone {
+			t.Errorf("step %v: %v", step.Name, step.Status)
+		}
+		// the account step completed in the first run and is not repeated
+		if step.Name == "auth" && step.Count != 1 {
+			t.Errorf("auth step count %d, want 1 from the first run", step.Count)
+		}
+	}
+	if left := fx.dataOf(uid); len(left) != 0 {
+		t.Errorf("data left %v", left)
+	}
+
+	events := fx.audit.Events()
+	if len(events) != 1 || events[0].Type != AuditUserErased || events[0].UID != uid || events[0].Outcome != AuditSuccess {
+		t.Errorf("audit events %+v, want one %v for %v", events, AuditUserErased, uid)
+	}
+}
+
+func TestErasureReportVerify(t *testing.T) {
+	fx := newErasureFixture(t)
+	uid := fx.addUser(t, "u@example.com")
+
+	report, err := fx.eraser.Erase(context.Background(), uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !report.Verify([]byte("test-signing-key")) {
+		t.Fatal("report does not verify with the signing key")
+	}
+	if report.Verify([]byte("other-key")) {
+		t.Error("report verifies with another key")
+	}
+
+	report.Steps[0].Count++
+	if report.Verify([]byte("test-signing-key")) {
+		t.Error("altered report verifies")
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// Sentinel errors for the identitytoolkit and securetoken error messages. Use errors.Is to test for them,
+// and errors.As with *Error to get the HTTP status and raw message returned by Firebase.
+var (
+	ErrEmailNotFound           = errors.New("email not found")
+	ErrInvalidPassword         = errors.New("invalid password")
+	ErrInvalidLoginCredentials = errors.New("invalid login credentials")
+	ErrUserDisabled            = errors.New("user disabled")
+	ErrUserNotFound            = errors.New("user not found")
+	ErrTooManyAttempts         = errors.New("too many attempts, try again later")
+	ErrTokenExpired            = errors.New("token expired")
+	ErrInvalidRefreshToken     = errors.New("invalid refresh token")
+	ErrMissingRefreshToken     = errors.New("missing refresh token")
+	ErrInvalidGrantType        = errors.New("invalid grant type")
+	ErrEmailExists             = errors.New("email already exists")
+	ErrInvalidEmail            = errors.New("invalid email")
+	ErrWeakPassword            = errors.New("weak password")
+	ErrOperationNotAllowed     = errors.New("operation not allowed")
+	ErrCredentialTooOld        = errors.New("credential too old, login again")
+	ErrInvalidOOBCode          = errors.New("invalid oob code")
+	ErrExpiredOOBCode          = errors.New("expired oob code")
+	ErrInvalidAPIKey           = errors.New("invalid api key")
+	ErrProjectNumberMismatch   = errors.New("project number mismatch")
+	ErrInvalidIdpResponse      = errors.New("invalid identity provider response")
+	ErrInvalidCustomToken      = errors.New("invalid custom token")
+	ErrCredentialMismatch      = errors.New("custom token is for a different project")
+	ErrCredentialAlreadyLinked = errors.New("credential already linked to another account")
+	ErrNeedConfirmation        = errors.New("account exists with a different credential")
+)
+
+// restErrors maps the Firebase error codes to the sentinel errors
+var restErrors = map[string]error{
+	"EMAIL_NOT_FOUND":                  ErrEmailNotFound,
+	"INVALID_PASSWORD":                 ErrInvalidPassword,
+	"INVALID_LOGIN_CREDENTIALS":        ErrInvalidLoginCredentials,
+	"USER_DISABLED":                    ErrUserDisabled,
+	"USER_NOT_FOUND":                   ErrUserNotFound,
+	"TOO_MANY_ATTEMPTS_TRY_LATER":      ErrTooManyAttempts,
+	"TOKEN_EXPIRED":                    ErrTokenExpired,
+	"INVALID_ID_TOKEN":                 ErrInvalidToken,
+	"INVALID_REFRESH_TOKEN":            ErrInvalidRefreshToken,
+	"MISSING_REFRESH_TOKEN":            ErrMissingRefreshToken,
+	"INVALID_GRANT_TYPE":               ErrInvalidGrantType,
+	"EMAIL_EXISTS":                     ErrEmailExists,
+	"INVALID_EMAIL":                    ErrInvalidEmail,
+	"WEAK_PASSWORD":                    ErrWeakPassword,
+	"OPERATION_NOT_ALLOWED":            ErrOperationNotAllowed,
+	"PASSWORD_LOGIN_DISABLED":          ErrOperationNotAllowed,
+	"CREDENTIAL_TOO_OLD_LOGIN_AGAIN":   ErrCredentialTooOld,
+	"INVALID_OOB_CODE":                 ErrInvalidOOBCode,
+	"EXPIRED_OOB_CODE":                 ErrExpiredOOBCode,
+	"PROJECT_NUMBER_MISMATCH":          ErrProjectNumberMismatch,
+	"INVALID_IDP_RESPONSE":             ErrInvalidIdpResponse,
+	"INVALID_CUSTOM_TOKEN":             ErrInvalidCustomToken,
+	"CREDENTIAL_MISMATCH":              ErrCredentialMismatch,
+	"FEDERATED_USER_ID_ALREADY_LINKED": ErrCredentialAlreadyLinked,
+}
+
+// Error is returned when the identitytoolkit or securetoken API responds with an error
+type Error struct {
+	StatusCode int    // HTTP status returned by Firebase
+	Code       string // error code, e.g. "INVALID_PASSWORD"
+	Message    string // raw message, e.g. "WEAK_PASSWORD : Password should be at least 6 characters"
+	err        error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("firebase returned http status %v: %v", e.StatusCode, e.Message)
+}
+
+// Unwrap returns the matching sentinel error, if any
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// newError parses a Firebase REST error body
+func newError(status int, body []byte) *Error {
+	e := &Error{
+		StatusCode: status,
+		Message:    string(body),
+	}
+
+	var fbErr FBLoginError
+	if err := json.Unmarshal(body, &fbErr); err != nil || fbErr.Error.Message == "" {
+		return e
+	}
+
+	e.Message = fbErr.Error.Message
+	e.Code = strings.TrimSpace(strings.SplitN(e.Message, ":", 2)[0])
+
+	if strings.HasPrefix(e.Message, "API key not valid") {
+		e.err = ErrInvalidAPIKey
+	} else {
+		e.err = restErrors[e.Code]
+	}
+
+	return e
+}
+
+// HTTPStatus suggests the status code a handler should answer with for err
+func HTTPStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrTooManyAttempts), errors.Is(err, ErrLockedOut):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrUserDisabled), errors.Is(err, ErrOperationNotAllowed), auth.IsUserDisabled(err),
+		errors.Is(err, ErrCallerNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, ErrEmailNotFound), errors.Is(err, ErrInvalidPassword), errors.Is(err, ErrInvalidLoginCredentials),
+		errors.Is(err, ErrUserNotFound), errors.Is(err, ErrTokenExpired), errors.Is(err, ErrInvalidToken),
+		errors.Is(err, ErrInvalidRefreshToken), errors.Is(err, ErrCredentialTooOld), errors.Is(err, ErrMissingToken),
+		errors.Is(err, ErrTokenRevoked), auth.IsIDTokenRevoked(err), errors.Is(err, ErrUnknownAPIKey), errors.Is(err, ErrAPIKeyExpired),
+		errors.Is(err, ErrInvalidIdpResponse), errors.Is(err, ErrInvalidCustomToken), auth.IsIDTokenInvalid(err):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrEmailExists), errors.Is(err, ErrCredentialAlreadyLinked), errors.Is(err, ErrNeedConfirmation):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidEmail), errors.Is(err, ErrWeakPassword), errors.Is(err, ErrMissingRefreshToken),
+		errors.Is(err, ErrInvalidGrantType), errors.Is(err, ErrInvalidOOBCode), errors.Is(err, ErrExpiredOOBCode),
+		errors.Is(err, ErrCredentialMismatch):
+		return http.StatusBadRequest
+	case auth.IsUserNotFound(err):
+		return http.StatusNotFound
+	}
+
+	var fbErr *Error
+	if errors.As(err, &fbErr) && fbErr.StatusCode >= 500 {
+		return http.StatusBadGateway
+	}
+
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,675 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+const (
+	fakeTokenLifetime  = 3600 // seconds
+	fakeCustomTokenAud = "https://identitytoolkit.googleapis.com/google.identity.identitytoolkit.v1.IdentityToolkit"
+	fakeMinPassword    = 6
+)
+
+// FakeAuth is an in-memory Authenticator for tests. It keeps a user table with hashed passwords,
+// custom claims and disabled state, and mints ID tokens with a TestSigner, so they verify with
+// Signer().Verifier() or a FirebaseAuth from Signer().FirebaseAuth(). UIDs, refresh tokens and
+// reset codes are numbered sequentially, and tokens only depend on the signer's key and clock.
+// Failures are returned as *Error with the same codes and sentinel errors as Firebase.
+type FakeAuth struct {
+	signer   *TestSigner
+	verifier *LocalVerifier
+
+	mu      sync.Mutex
+	users   map[string]*fakeUser
+	byEmail map[string]string // lower-cased email to uid
+	refresh map[string]string // refresh token to uid
+	seq     int
+	policy  *PasswordPolicy
+}
+
+type fakeUser struct {
+	uid      string
+	email    string
+	phone    string
+	password [sha256.Size]byte
+	hasPwd   bool
+	name     string
+	avatar   string
+	verified bool
+	disabled bool
+	claims   map[string]interface{}
+	validAt  int64 // refresh tokens revoked before this, seconds since epoch like Firebase
+}
+
+// NewFakeAuth creates an empty FakeAuth for projectID with a fresh signing key
+func NewFakeAuth(projectID string) (*FakeAuth, error) {
+	signer, err := NewTestSigner(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFakeAuthWithSigner(signer), nil
+}
+
+// NewFakeAuthWithSigner uses signer to mint tokens, e.g. one with a fixed key and clock
+func NewFakeAuthWithSigner(signer *TestSigner) *FakeAuth {
+	return &FakeAuth{
+		signer:   signer,
+		verifier: signer.Verifier(),
+		users:    make(map[string]*fakeUser),
+		byEmail:  make(map[string]string),
+		refresh:  make(map[string]string),
+	}
+}
+
+// Signer returns the TestSigner the ID tokens are minted with
+func (fa *FakeAuth) Signer() *TestSigner {
+	return fa.signer
+}
+
+// SetPasswordPolicy enforces policy like WithPasswordPolicy does for FirebaseAuth
+func (fa *FakeAuth) SetPasswordPolicy(policy *PasswordPolicy) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	fa.policy = policy
+}
+
+// SetCustomClaims replaces the user's custom claims. They show up in tokens minted afterwards.
+func (fa *FakeAuth) SetCustomClaims(uid string, claims map[string]interface{}) error {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	user, err := fa.user(uid)
+	if err != nil {
+		return err
+	}
+
+	user.claims = copyClaims(claims)
+
+	return nil
+}
+
+// GetUser returns a snapshot of the user
+func (fa *FakeAuth) GetUser(uid string) (*auth.UserRecord, error) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	user, err := fa.user(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	return user.record(), nil
+}
+
+// GetUserContext
+func (fa *FakeAuth) GetUserContext(ctx context.Context, uid string) (*auth.UserRecord, error) {
+	return fa.GetUser(uid)
+}
+
+// Login
+func (fa *FakeAuth) Login(email string, password string) (*FBLoginResp, error) {
+	return fa.LoginContext(context.Background(), email, password)
+}
+
+// LoginContext
+func (fa *FakeAuth) LoginContext(ctx context.Context, email string, password string) (*FBLoginResp, error) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	uid, ok := fa.byEmail[strings.ToLower(email)]
+	if !ok {
+		return nil, fakeError("INVALID_LOGIN_CREDENTIALS", ErrInvalidLoginCredentials)
+	}
+
+	user := fa.users[uid]
+	if !user.hasPwd || user.password != sha256.Sum256([]byte(password)) {
+		return nil, fakeError("INVALID_LOGIN_CREDENTIALS", ErrInvalidLoginCredentials)
+	}
+	if user.disabled {
+		return nil, fakeError("USER_DISABLED", ErrUserDisabled)
+	}
+
+	idToken, err := fa.idToken(user)
+	if err != nil {
+		return nil, err
+	}
+
+	fa.seq++
+	refreshToken := fmt.Sprintf("fake-refresh-%06d", fa.seq)
+	fa.refresh[refreshToken] = uid
+
+	return &FBLoginResp{
+		UID:          uid,
+		Email:        user.email,
+		DisplayName:  user.name,
+		IDToken:      idToken,
+		Registered:   true,
+		RefreshToken: refreshToken,
+		ExpiresIn:    fmt.Sprint(fakeTokenLifetime),
+	}, nil
+}
+
+// RefreshToken
+func (fa *FakeAuth) RefreshToken(refreshToken string) (*FBRefreshTokenResp, error) {
+	return fa.RefreshTokenContext(context.Background(), refreshToken)
+}
+
+// RefreshTokenContext
+func (fa *FakeAuth) RefreshTokenContext(ctx context.Context, refreshToken string) (*FBRefreshTokenResp, error) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	if refreshToken == "" {
+		return nil, fakeError("MISSING_REFRESH_TOKEN", ErrMissingRefreshToken)
+	}
+
+	uid, ok := fa.refresh[refreshToken]
+	if !ok {
+		return nil, fakeError("INVALID_REFRESH_TOKEN", ErrInvalidRefreshToken)
+	}
+
+	user, ok := fa.users[uid]
+	if !ok {
+		return nil, fakeError("USER_NOT_FOUND", ErrUserNotFound)
+	}
+	if user.disabled {
+		return nil, fakeError("USER_DISABLED", ErrUserDisabled)
+	}
+
+	idToken, err := fa.idToken(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FBRefreshTokenResp{
+		UID:          uid,
+		ProjectID:    fa.signer.projectID,
+		ExpiresIn:    fmt.Sprint(fakeTokenLifetime),
+		TokenType:    "Bearer",
+		RefreshToken: refreshToken,
+		IDToken:      idToken,
+	}, nil
+}
+
+// CreateUser
+func (fa *FakeAuth) CreateUser(email string, phone string, pwd string, name string, avatar string, verified bool, disabled bool) (string, error) {
+	return fa.CreateUserContext(context.Background(), email, phone, pwd, name, avatar, verified, disabled)
+}
+
+// CreateUserContext
+func (fa *FakeAuth) CreateUserContext(ctx context.Context, email string, phone string, pwd string, name string, avatar string, verified bool, disabled bool) (string, error) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	// the Admin SDK rejects empty values before calling Firebase
+	if email == "" {
+		return "", fakeError("INVALID_EMAIL", ErrInvalidEmail)
+	}
+	if name == "" {
+		return "", fmt.Errorf("display name must be a non-empty string")
+	}
+	if err := fa.checkEmail(email, ""); err != nil {
+		return "", err
+	}
+
+	fa.seq++
+	user := &fakeUser{
+		uid:      fmt.Sprintf("fake-uid-%06d", fa.seq),
+		email:    email,
+		phone:    phone,
+		name:     name,
+		avatar:   avatar,
+		verified: verified,
+		disabled: disabled,
+	}
+
+	if err := fa.setPassword(ctx, user, pwd, email); err != nil {
+		return "", err
+	}
+
+	fa.users[user.uid] = user
+	fa.byEmail[strings.ToLower(email)] = user.uid
+
+	return user.uid, nil
+}
+
+// UpdateUser sets every field, like FirebaseAuth.UpdateUser
+func (fa *FakeAuth) UpdateUser(uid string, email string, pwd string, name string, avatar string, phone string, verified bool, disabled bool) error {
+	return fa.UpdateUserContext(context.Background(), uid, email, pwd, name, avatar, phone, verified, disabled)
+}
+
+// UpdateUserContext
+func (fa *FakeAuth) UpdateUserContext(ctx context.Context, uid string, email string, pwd string, name string, avatar string, phone string, verified bool, disabled bool) error {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	user, err := fa.user(uid)
+	if err != nil {
+		return err
+	}
+	if email == "" {
+		return fakeError("INVALID_EMAIL", ErrInvalidEmail)
+	}
+	if err = fa.checkEmail(email, uid); err != nil {
+		return err
+	}
+	if err = fa.setPassword(ctx, user, pwd, email); err != nil {
+		return err
+	}
+
+	fa.setEmail(user, email)
+	user.name = name
+	user.avatar = avatar
+	user.phone = phone
+	user.verified = verified
+	user.disabled = disabled
+
+	return nil
+}
+
+// UpdateUserFields applies the non-nil fields of update, like FirebaseAuth.UpdateUserFields. The user is
+// left unchanged when any field is rejected. FakeAuth keeps no federated identities, so ProviderToLink is
+// rejected and ProvidersToDelete only unlinks ProviderPassword and ProviderPhone.
+func (fa *FakeAuth) UpdateUserFields(ctx context.Context, uid string, update *UserUpdate) (*auth.UserRecord, error) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	user, err := fa.user(uid)
+	if err != nil {
+		return nil, err
+	}
+	if update.ProviderToLink != nil {
+		return nil, fmt.Errorf("FakeAuth does not support ProviderToLink")
+	}
+
+	updated := *user
+
+	if update.Email != nil {
+		if *update.Email == "" {
+			return nil, fakeError("INVALID_EMAIL", ErrInvalidEmail)
+		}
+		if err = fa.checkEmail(*update.Email, uid); err != nil {
+			return nil, err
+		}
+		updated.email = *update.Email
+	}
+	if update.Password != nil {
+		if err = fa.setPassword(ctx, &updated, *update.Password, updated.email); err != nil {
+			return nil, err
+		}
+	}
+	if update.CustomClaims != nil {
+		if err = checkBlockingClaims("custom", update.CustomClaims); err != nil {
+			return nil, err
+		}
+		updated.claims = copyClaims(update.CustomClaims)
+	}
+	if update.DisplayName != nil {
+		updated.name = *update.DisplayName
+	}
+	if update.PhotoURL != nil {
+		updated.avatar = *update.PhotoURL
+	}
+	if update.PhoneNumber != nil {
+		updated.phone = *update.PhoneNumber
+	}
+	if update.EmailVerified != nil {
+		updated.verified = *update.EmailVerified
+	}
+	if update.Disabled != nil {
+		updated.disabled = *update.Disabled
+	}
+	for _, provider := range update.ProvidersToDelete {
+		switch provider {
+		case ProviderPassword:
+			updated.password, updated.hasPwd = [sha256.Size]byte{}, false
+		case ProviderPhone:
+			updated.phone = ""
+		}
+	}
+
+	email := updated.email
+	updated.email = user.email
+	*user = updated
+	fa.setEmail(user, email)
+
+	return user.record(), nil
+}
+
+// UpdateUserEmail
+func (fa *FakeAuth) UpdateUserEmail(uid string, email string) error {
+	return fa.UpdateUserEmailContext(context.Background(), uid, email)
+}
+
+// UpdateUserEmailContext
+func (fa *FakeAuth) UpdateUserEmailContext(ctx context.Context, uid string, email string) error {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	user, err := fa.user(uid)
+	if err != nil {
+		return err
+	}
+	if email == "" {
+		return fakeError("INVALID_EMAIL", ErrInvalidEmail)
+	}
+	if err = fa.checkEmail(email, uid); err != nil {
+		return err
+	}
+
+	fa.setEmail(user, email)
+
+	return nil
+}
+
+// UpdateUserPassword
+func (fa *FakeAuth) UpdateUserPassword(uid string, password string) error {
+	return fa.UpdateUserPasswordContext(context.Background(), uid, password)
+}
+
+// UpdateUserPasswordContext
+func (fa *FakeAuth) UpdateUserPasswordContext(ctx context.Context, uid string, password string) error {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	user, err := fa.user(uid)
+	if err != nil {
+		return err
+	}
+
+	return fa.setPassword(ctx, user, password, user.email)
+}
+
+// UpdateUserDisabled
+func (fa *FakeAuth) UpdateUserDisabled(uid string, disabled bool) error {
+	return fa.UpdateUserDisabledContext(context.Background(), uid, disabled)
+}
+
+// UpdateUserDisabledContext
+func (fa *FakeAuth) UpdateUserDisabledContext(ctx context.Context, uid string, disabled bool) error {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	user, err := fa.user(uid)
+	if err != nil {
+		return err
+	}
+
+	user.disabled = disabled
+
+	return nil
+}
+
+// RevokeRefreshTokens
+func (fa *FakeAuth) RevokeRefreshTokens(uid string) error {
+	return fa.RevokeRefreshTokensContext(context.Background(), uid)
+}
+
+// RevokeRefreshTokensContext drops the user's refresh tokens and sets TokensValidAfterMillis to the
+// signer's clock, truncated to the second as Firebase does
+func (fa *FakeAuth) RevokeRefreshTokensContext(ctx context.Context, uid string) error {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	user, err := fa.user(uid)
+	if err != nil {
+		return err
+	}
+
+	user.validAt = fa.signer.now().Unix()
+	fa.dropRefreshTokens(uid)
+
+	return nil
+}
+
+// DeleteUser removes the user with its email and refresh tokens
+func (fa *FakeAuth) DeleteUser(ctx context.Context, uid string) error {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	user, err := fa.user(uid)
+	if err != nil {
+		return err
+	}
+
+	fa.setEmail(user, "")
+	fa.dropRefreshTokens(uid)
+	delete(fa.users, uid)
+
+	return nil
+}
+
+// CheckUserExists
+func (fa *FakeAuth) CheckUserExists(email string) (bool, error) {
+	return fa.CheckUserExistsContext(context.Background(), email)
+}
+
+// CheckUserExistsContext
+func (fa *FakeAuth) CheckUserExistsContext(ctx context.Context, email string) (bool, error) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	_, ok := fa.byEmail[strings.ToLower(email)]
+	return ok, nil
+}
+
+// ResetPasswordLink
+func (fa *FakeAuth) ResetPasswordLink(email string) (string, error) {
+	return fa.ResetPasswordLinkContext(context.Background(), email)
+}
+
+// ResetPasswordLinkContext returns a link in the format Firebase uses, with a sequential oobCode
+func (fa *FakeAuth) ResetPasswordLinkContext(ctx context.Context, email string) (string, error) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	if _, ok := fa.byEmail[strings.ToLower(email)]; !ok {
+		return "", fakeError("EMAIL_NOT_FOUND", ErrEmailNotFound)
+	}
+
+	fa.seq++
+
+	return fmt.Sprintf("https://%v.firebaseapp.com/__/auth/action?mode=resetPassword&oobCode=fake-oob-%06d&apiKey=test-api-key",
+		fa.signer.projectID, fa.seq), nil
+}
+
+// VerifyToken
+func (fa *FakeAuth) VerifyToken(idToken string) (*auth.Token, error) {
+	return fa.VerifyTokenContext(context.Background(), idToken)
+}
+
+// VerifyTokenContext
+func (fa *FakeAuth) VerifyTokenContext(ctx context.Context, idToken string) (*auth.Token, error) {
+	return fa.verifier.VerifyIDToken(ctx, idToken)
+}
+
+// CreateToken
+func (fa *FakeAuth) CreateToken(uid string, claims map[string]interface{}) (string, error) {
+	return fa.CreateTokenContext(context.Background(), uid, claims)
+}
+
+// CreateTokenContext mints a custom token shaped like the ones the Admin SDK creates
+func (fa *FakeAuth) CreateTokenContext(ctx context.Context, uid string, claims map[string]interface{}) (string, error) {
+	now := fa.signer.now().Unix()
+	serviceAccount := "firebase-adminsdk@" + fa.signer.projectID + ".iam.gserviceaccount.com"
+
+	payload := map[string]interface{}{
+		"iss": serviceAccount,
+		"sub": serviceAccount,
+		"aud": fakeCustomTokenAud,
+		"uid": uid,
+		"iat": now,
+		"exp": now + fakeTokenLifetime,
+	}
+	if len(claims) > 0 {
+		payload["claims"] = claims
+	}
+
+	return fa.signer.Sign(payload)
+}
+
+// GetRoleFromToken
+func (fa *FakeAuth) GetRoleFromToken(idToken string) (string, error) {
+	return fa.GetRoleFromTokenContext(context.Background(), idToken)
+}
+
+// GetRoleFromTokenContext
+func (fa *FakeAuth) GetRoleFromTokenContext(ctx context.Context, idToken string) (string, error) {
+	token, err := fa.VerifyTokenContext(ctx, idToken)
+	if err != nil {
+		return "", err
+	}
+
+	return roleFromClaims(token.Claims), nil
+}
+
+// user returns the user or a USER_NOT_FOUND error. The caller holds mu.
+func (fa *FakeAuth) user(uid string) (*fakeUser, error) {
+	user, ok := fa.users[uid]
+	if !ok {
+		return nil, fakeError("USER_NOT_FOUND", ErrUserNotFound)
+	}
+
+	return user, nil
+}
+
+// checkEmail rejects malformed addresses and ones taken by another user. The caller holds mu.
+func (fa *FakeAuth) checkEmail(email string, uid string) error {
+	if email == "" {
+		return nil
+	}
+
+	if local, domain, ok := strings.Cut(email, "@"); !ok || local == "" || domain == "" {
+		return fakeError("INVALID_EMAIL", ErrInvalidEmail)
+	}
+
+	if owner, ok := fa.byEmail[strings.ToLower(email)]; ok && owner != uid {
+		return fakeError("EMAIL_EXISTS", ErrEmailExists)
+	}
+
+	return nil
+}
+
+// dropRefreshTokens forgets the refresh tokens issued to uid. The caller holds mu.
+func (fa *FakeAuth) dropRefreshTokens(uid string) {
+	for token, owner := range fa.refresh {
+		if owner == uid {
+			delete(fa.refresh, token)
+		}
+	}
+}
+
+// setEmail updates the user and the email index. The caller holds mu.
+func (fa *FakeAuth) setEmail(user *fakeUser, email string) {
+	if user.email != "" {
+		delete(fa.byEmail, strings.ToLower(user.email))
+	}
+
+	user.email = email
+	if email != "" {
+		fa.byEmail[strings.ToLower(email)] = user.uid
+	}
+}
+
+// setPassword applies the policy and Firebase's minimum length. The caller holds mu.
+func (fa *FakeAuth) setPassword(ctx context.Context, user *fakeUser, password string, email string) error {
+	if fa.policy != nil {
+		if err := fa.policy.Check(ctx, password, email); err != nil {
+			return err
+		}
+	}
+
+	if len(password) < fakeMinPassword {
+		return &Error{
+			StatusCode: http.StatusBadRequest,
+			Code:       "WEAK_PASSWORD",
+			Message:    "WEAK_PASSWORD : Password should be at least 6 characters",
+			err:        ErrWeakPassword,
+		}
+	}
+
+	user.password = sha256.Sum256([]byte(password))
+	user.hasPwd = true
+
+	return nil
+}
+
+// idToken mints an ID token carrying the user's profile and custom claims. The caller holds mu.
+func (fa *FakeAuth) idToken(user *fakeUser) (string, error) {
+	claims := copyClaims(user.claims)
+
+	identities := map[string]interface{}{}
+	if user.email != "" {
+		claims["email"] = user.email
+		claims["email_verified"] = user.verified
+		identities["email"] = []string{user.email}
+	}
+	if user.phone != "" {
+		claims["phone_number"] = user.phone
+		identities["phone"] = []string{user.phone}
+	}
+	if user.name != "" {
+		claims["name"] = user.name
+	}
+	if user.avatar != "" {
+		claims["picture"] = user.avatar
+	}
+
+	claims["firebase"] = map[string]interface{}{
+		"sign_in_provider": ProviderPassword,
+		"identities":       identities,
+	}
+
+	return fa.signer.IDToken(user.uid, claims)
+}
+
+// record returns a snapshot of the user. The caller holds mu.
+func (user *fakeUser) record() *auth.UserRecord {
+	return &auth.UserRecord{
+		UserInfo: &auth.UserInfo{
+			UID:         user.uid,
+			Email:       user.email,
+			PhoneNumber: user.phone,
+			DisplayName: user.name,
+			PhotoURL:    user.avatar,
+			ProviderID:  "firebase",
+		},
+		EmailVerified:          user.verified,
+		Disabled:               user.disabled,
+		CustomClaims:           copyClaims(user.claims),
+		TokensValidAfterMillis: user.validAt * 1000,
+	}
+}
+
+// fakeError builds the *Error Firebase would return for code
+func fakeError(code string, sentinel error) *Error {
+	return &Error{
+		StatusCode: http.StatusBadRequest,
+		Code:       code,
+		Message:    code,
+		err:        sentinel,
+	}
+}
+
+// copyClaims returns a shallow copy that is never nil
+func copyClaims(claims map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(claims))
+	for k, v := range claims {
+		out[k] = v
+	}
+
+	return out
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/url"
+)
+
+// Provider IDs used by Firebase Auth
+const (
+	ProviderPassword  = "password"
+	ProviderPhone     = "phone"
+	ProviderGoogle    = "google.com"
+	ProviderApple     = "apple.com"
+	ProviderFacebook  = "facebook.com"
+	ProviderGithub    = "github.com"
+	ProviderTwitter   = "twitter.com"
+	ProviderMicrosoft = "microsoft.com"
+)
+
+// defaultRequestURI is sent as requestUri when IdpCredential has none. Firebase requires the field
+// but only checks it for redirect based flows, not for credentials obtained by a native SDK.
+const defaultRequestURI = "http://localhost"
+
+// IdpCredential is a credential issued by a federated identity provider, e.g. the ID token
+// returned by Sign in with Apple or Google Sign-In on a mobile device
+type IdpCredential struct {
+	ProviderID       string // e.g. ProviderGoogle
+	IDToken          string // OIDC ID token, if the provider issued one
+	AccessToken      string // OAuth access token, for providers without ID tokens
+	OAuthTokenSecret string // OAuth 1.0 token secret (Twitter)
+	Nonce            string // raw nonce the ID token was requested with (Apple)
+	RequestURI       string // URI the credential was returned to, defaults to http://localhost
+}
+
+// postBody encodes the credential the way accounts:signInWithIdp expects it
+func (c *IdpCredential) postBody() string {
+	v := url.Values{}
+	v.Set("providerId", c.ProviderID)
+
+	if c.IDToken != "" {
+		v.Set("id_token", c.IDToken)
+	}
+	if c.AccessToken != "" {
+		v.Set("access_token", c.AccessToken)
+	}
+	if c.OAuthTokenSecret != "" {
+		v.Set("oauth_token_secret", c.OAuthTokenSecret)
+	}
+	if c.Nonce != "" {
+		v.Set("nonce", c.Nonce)
+	}
+
+	return v.Encode()
+}
+
+// FBIdpResp is returned by accounts:signInWithIdp
+type FBIdpResp struct {
+	ProviderID       string `json:"providerId"`
+	FederatedID      string `json:"federatedId"`
+	UID              string `json:"localId"`
+	Email            string `json:"email"`
+	EmailVerified    bool   `json:"emailVerified"`
+	DisplayName      string `json:"displayName"`
+	FullName         string `json:"fullName"`
+	FirstName        string `json:"firstName"`
+	LastName         string `json:"lastName"`
+	PhotoURL         string `json:"photoUrl"`
+	IDToken          string `json:"idToken"`
+	RefreshToken     string `json:"refreshToken"`
+	ExpiresIn        string `json:"expiresIn"`
+	OAuthIDToken     string `json:"oauthIdToken"`
+	OAuthAccessToken string `json:"oauthAccessToken"`
+	RawUserInfo      string `json:"rawUserInfo"`
+	IsNewUser        bool   `json:"isNewUser"`
+	NeedConfirmation bool   `json:"needConfirmation"`
+}
+
+// FBCustomTokenResp is returned by accounts:signInWithCustomToken
+type FBCustomTokenResp struct {
+	IDToken      string `json:"idToken"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    string `json:"expiresIn"`
+	IsNewUser    bool   `json:"isNewUser"`
+}
+
+// SignInWithIdp exchanges a provider credential for Firebase tokens, creating the account on first use.
+// If the email already belongs to an account using a different provider, the response is returned
+// together with ErrNeedConfirmation and has no tokens; sign the user in with the existing provider
+// and call LinkWithIdp.
+func (f *FirebaseAuth) SignInWithIdp(ctx context.Context, cred *IdpCredential) (*FBIdpResp, error) {
+	return f.signInWithIdp(ctx, "", cred)
+}
+
+// LinkWithIdp links a provider credential to the account owning idToken. The returned tokens replace the old ones.
+func (f *FirebaseAuth) LinkWithIdp(ctx context.Context, idToken string, cred *IdpCredential) (*FBIdpResp, error) {
+	if idToken == "" {
+		return nil, ErrMissingToken
+	}
+
+	return f.signInWithIdp(ctx, idToken, cred)
+}
+
+// signInWithIdp calls accounts:signInWithIdp, linking to idToken's account when set
+func (f *FirebaseAuth) signInWithIdp(ctx context.Context, idToken string, cred *IdpCredential) (*FBIdpResp, error) {
+	if cred == nil || cred.ProviderID == "" {
+		return nil, errors.New("missing provider credential")
+	}
+
+	requestURI := cred.RequestURI
+	if requestURI == "" {
+		requestURI = defaultRequestURI
+	}
+
+	req := map[string]interface{}{
+		"postBody":            cred.postBody(),
+		"requestUri":          requestURI,
+		"returnIdpCredential": true,
+		"returnSecureToken":   true,
+	}
+	if idToken != "" {
+		req["idToken"] = idToken
+	}
+
+	var resp FBIdpResp
+	err := f.postJSON(ctx, "/accounts:signInWithIdp", req, &resp)
+	if err == nil && resp.NeedConfirmation {
+		err = ErrNeedConfirmation
+	}
+
+	// linking is not a sign-in
+	if idToken == "" {
+		f.audit(ctx, &AuditEvent{Type: AuditLogin, UID: resp.UID, Details: map[string]interface{}{"provider": cred.ProviderID}}, err)
+	}
+
+	if errors.Is(err, ErrNeedConfirmation) {
+		return &resp, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// SignInWithCustomToken exchanges a custom token, e.g. one from CreateToken, for an ID and refresh token
+func (f *FirebaseAuth) SignInWithCustomToken(ctx context.Context, customToken string) (*FBCustomTokenResp, error) {
+	var resp FBCustomTokenResp
+
+	err := f.postJSON(ctx, "/accounts:signInWithCustomToken", map[string]interface{}{
+		"token":             customToken,
+		"returnSecureToken": true,
+	}, &resp)
+	f.audit(ctx, &AuditEvent{Type: AuditLogin, UID: tokenSubject(customToken), Details: map[string]interface{}{"method": "custom_token"}}, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// SignInAsUser mints a custom token for uid and exchanges it for an ID and refresh token, e.g. for
+// service accounts or tests that need a real session. claims become custom claims of the ID token.
+func (f *FirebaseAuth) SignInAsUser(ctx context.Context, uid string, claims map[string]interface{}) (*FBCustomTokenResp, error) {
+	customToken, err := f.CreateTokenContext(ctx, uid, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.SignInWithCustomToken(ctx, customToken)
+}
+
+// LinkWithPassword adds email/password sign-in to the account owning idToken, e.g. one created
+// with SignInWithIdp. The returned tokens replace the old ones.
+func (f *FirebaseAuth) LinkWithPassword(ctx context.Context, idToken string, email string, password string) (*FBAccountResp, error) {
+	if err := f.checkPassword(ctx, password, email); err != nil {
+		return nil, err
+	}
+
+	resp, err := f.updateAccount(ctx, map[string]interface{}{
+		"idToken":           idToken,
+		"email":             email,
+		"password":          password,
+		"returnSecureToken": true,
+	})
+	f.audit(ctx, &AuditEvent{Type: AuditPasswordChanged, UID: tokenSubject(idToken), Details: map[string]interface{}{"linked": true}}, err)
+
+	return resp, err
+}
+
+// UnlinkProviders removes providers, e.g. ProviderGoogle or ProviderPassword, from the account owning idToken.
+// Use UpdateUserFields with ProvidersToDelete to unlink as an administrator.
+func (f *FirebaseAuth) UnlinkProviders(ctx context.Context, idToken string, providerIDs ...string) (*FBAccountResp, error) {
+	return f.updateAccount(ctx, map[string]interface{}{
+		"idToken":        idToken,
+		"deleteProvider": providerIDs,
+	})
+}
@@ -8,20 +8,22 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 
 	"firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/auth"
+	"google.golang.org/api/option"
 )
 
 const (
-	baseURL      = "https://identitytoolkit.googleapis.com/v1"
-	tokenBaseURL = "https://securetoken.googleapis.com/v1"
+	defaultBaseURL      = "https://identitytoolkit.googleapis.com/v1"
+	defaultTokenBaseURL = "https://securetoken.googleapis.com/v1"
 
 	contentTypeJSON = "application/json"
 	contentTypeForm = "application/x-www-form-urlencoded"
@@ -29,9 +31,12 @@ const (
 
 /* Auth info from Cloud Endpoints + Firebase */
 type EndpointUser struct {
-	UID    string `json:"id"`
-	Issuer string `json:"issuer"`
-	Email  string `json:"email"`
+	UID       string                 `json:"id"`
+	Issuer    string                 `json:"issuer"`
+	Email     string                 `json:"email"`
+	Audiences []string               `json:"audiences,omitempty"`
+	Firebase  Firebase               `json:"firebase"`
+	Claims    map[string]interface{} `json:"-"`
 }
 
 /* Auth info from API Gateway */
@@ -48,16 +53,24 @@ type GatewayUser struct {
 	Email         string   `json:"email"`
 	EmailVerified bool     `json:"email_verified"`
 	Firebase      Firebase `json:"firebase"`
+
+	Claims map[string]interface{} `json:"-"`
 }
 
 type Firebase struct {
 	Identities     Identities `json:"identities"`
 	SignInProvider string     `json:"sign_in_provider"`
+	Tenant         string     `json:"tenant,omitempty"`
 }
 
 type Identities struct {
-	GoogleCom []string `json:"google.com"`
-	Email     []string `json:"email"`
+	GoogleCom   []string `json:"google.com"`
+	Email       []string `json:"email"`
+	Phone       []string `json:"phone,omitempty"`
+	AppleCom    []string `json:"apple.com,omitempty"`
+	FacebookCom []string `json:"facebook.com,omitempty"`
+	GithubCom   []string `json:"github.com,omitempty"`
+	TwitterCom  []string `json:"twitter.com,omitempty"`
 }
 
 type FBLoginResp struct {
@@ -77,6 +90,7 @@ type FBLoginError struct {
 type FBError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
+	Status  string `json:"status,omitempty"`
 }
 
 type FBRefreshTokenResp struct {
@@ -89,13 +103,86 @@ type FBRefreshTokenResp struct {
 }
 
 type FirebaseAuth struct {
-	apiKey string
-	client *auth.Client
+	apiKey         string
+	client         userClient   // project or tenant scoped
+	project        *auth.Client // project level, for tenant management and session cookies
+	tenantID       string
+	projectID      string
+	httpClient     *http.Client
+	baseURL        string
+	tokenBaseURL   string
+	guard          *LoginGuard
+	verifier       TokenVerifier // overrides client for ID token verification when set
+	cache          *TokenCache
+	auditSink      AuditSink
+	passwordPolicy *PasswordPolicy
+
+	appConfig  *firebase.Config
+	clientOpts []option.ClientOption
+}
+
+// Option configures optional FirebaseAuth settings in NewFirebaseAuth
+type Option func(*FirebaseAuth)
+
+// WithHTTPClient sets the http.Client used for the identitytoolkit and securetoken REST calls
+func WithHTTPClient(client *http.Client) Option {
+	return func(f *FirebaseAuth) {
+		f.httpClient = client
+	}
+}
+
+// WithBaseURL overrides the identitytoolkit base URL (e.g. an httptest server in CI)
+func WithBaseURL(baseURL string) Option {
+	return func(f *FirebaseAuth) {
+		f.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithTokenBaseURL overrides the securetoken base URL
+func WithTokenBaseURL(tokenBaseURL string) Option {
+	return func(f *FirebaseAuth) {
+		f.tokenBaseURL = strings.TrimSuffix(tokenBaseURL, "/")
+	}
+}
+
+// WithEmulatorHost points both REST base URLs at a Firebase Auth emulator running on host (e.g. "localhost:9099").
+// The Admin SDK calls read FIREBASE_AUTH_EMULATOR_HOST on their own, so that should be set as well.
+func WithEmulatorHost(host string) Option {
+	return func(f *FirebaseAuth) {
+		f.baseURL = "http://" + host + "/identitytoolkit.googleapis.com/v1"
+		f.tokenBaseURL = "http://" + host + "/securetoken.googleapis.com/v1"
+	}
+}
+
+// WithFirebaseConfig sets the firebase.Config used to create the app, e.g. to set the ProjectID
+func WithFirebaseConfig(config *firebase.Config) Option {
+	return func(f *FirebaseAuth) {
+		f.appConfig = config
+	}
+}
+
+// WithClientOptions passes Google API client options to the Admin SDK, e.g. option.WithCredentialsFile.
+// Together with option.WithoutAuthentication and WithTokenVerifier this allows running without credentials in tests.
+func WithClientOptions(opts ...option.ClientOption) Option {
+	return func(f *FirebaseAuth) {
+		f.clientOpts = append(f.clientOpts, opts...)
+	}
 }
 
 // NewFirebaseAuth
-func NewFirebaseAuth(apiKey string) (*FirebaseAuth, error) {
-	fbApp, err := firebase.NewApp(context.Background(), nil)
+func NewFirebaseAuth(apiKey string, opts ...Option) (*FirebaseAuth, error) {
+	f := &FirebaseAuth{
+		apiKey:       apiKey,
+		httpClient:   http.DefaultClient,
+		baseURL:      defaultBaseURL,
+		tokenBaseURL: defaultTokenBaseURL,
+	}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	fbApp, err := firebase.NewApp(context.Background(), f.appConfig, f.clientOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -106,55 +193,67 @@ func NewFirebaseAuth(apiKey string) (*FirebaseAuth, error) {
 		return nil, err
 	}
 
-	return &FirebaseAuth{
-		client: authClient,
-		apiKey: apiKey,
-	}, nil
+	f.client = authClient
+	f.project = authClient
+	f.projectID = resolveProjectID(f.appConfig)
+
+	return f, nil
 }
 
-// Login
-func (f *FirebaseAuth) Login(email string, password string) (*FBLoginResp, *FBLoginError) {
-	req, err := json.Marshal(map[string]interface{}{
-		"email":             email,
-		"password":          password,
-		"returnSecureToken": true,
-	})
+// ProjectID returns the project from the firebase.Config or the environment, or "" if neither sets it
+func (f *FirebaseAuth) ProjectID() string {
+	return f.projectID
+}
 
-	if err != nil {
-		return nil, &FBLoginError{Error: FBError{
-			Code:    http.StatusInternalServerError,
-			Message: err.Error(),
-		}}
+// resolveProjectID follows the Admin SDK, minus the credentials file which it does not expose
+func resolveProjectID(config *firebase.Config) string {
+	if config != nil && config.ProjectID != "" {
+		return config.ProjectID
 	}
-
-	resp, status, err := submitPost(baseURL, "/accounts:signInWithPassword?key="+f.apiKey, req)
-	if err != nil {
-		return nil, &FBLoginError{Error: FBError{
-			Code:    http.StatusInternalServerError,
-			Message: err.Error(),
-		}}
+	if id := os.Getenv("GOOGLE_CLOUD_PROJECT"); id != "" {
+		return id
 	}
 
-	if status != 200 {
-		var loginError FBLoginError
+	return os.Getenv("GCLOUD_PROJECT")
+}
 
-		if err = json.Unmarshal(resp, &loginError); err != nil {
-			return nil, &FBLoginError{Error: FBError{
-				Code:    http.StatusInternalServerError,
-				Message: err.Error(),
-			}}
-		}
+// Login
+func (f *FirebaseAuth) Login(email string, password string) (*FBLoginResp, error) {
+	return f.LoginContext(context.Background(), email, password)
+}
+
+// LoginContext
+func (f *FirebaseAuth) LoginContext(ctx context.Context, email string, password string) (*FBLoginResp, error) {
+	ip := ClientIPFromContext(ctx)
 
-		return nil, &loginError
+	if f.guard != nil {
+		if err := f.guard.Check(ctx, email, ip); err != nil {
+			f.audit(ctx, &AuditEvent{Type: AuditLogin, Details: map[string]interface{}{"email": email}}, err)
+			return nil, err
+		}
 	}
 
 	var fbLoginResp FBLoginResp
 
-	if err = json.Unmarshal(resp, &fbLoginResp); err != nil {
-		return nil, &FBLoginError{Error: FBError{
-			Code:    http.StatusInternalServerError,
-			Message: err.Error(),
-		}}
+	err := f.postJSON(ctx, "/accounts:signInWithPassword", map[string]interface{}{
+		"email":             email,
+		"password":          password,
+		"returnSecureToken": true,
+	}, &fbLoginResp)
+
+	f.audit(ctx, &AuditEvent{Type: AuditLogin, UID: fbLoginResp.UID, Details: map[string]interface{}{"email": email}}, err)
+
+	if err != nil {
+		if f.guard != nil {
+			if guardErr := f.guard.RecordFailure(ctx, email, ip, err); guardErr != nil {
+				log.Printf("failed to record login failure. %v", guardErr)
+			}
+		}
+		return nil, err
+	}
+
+	if f.guard != nil {
+		f.guard.RecordSuccess(ctx, email, ip)
 	}
 
 	return &fbLoginResp, nil
@@ -162,21 +261,22 @@ func (f *FirebaseAuth) Login(email string, password string) (*FBLoginResp, *FBLo
 
 // RefreshToken
 func (f *FirebaseAuth) RefreshToken(refreshToken string) (*FBRefreshTokenResp, error) {
+	return f.RefreshTokenContext(context.Background(), refreshToken)
+}
+
+// RefreshTokenContext
+func (f *FirebaseAuth) RefreshTokenContext(ctx context.Context, refreshToken string) (*FBRefreshTokenResp, error) {
 	req := url.Values{}
 	req.Set("grant_type", "refresh_token")
 	req.Set("refresh_token", refreshToken)
 
-	resp, status, err := submitForm(tokenBaseURL, "/token?key="+f.apiKey, &req)
+	resp, status, err := f.submitForm(ctx, f.tokenBaseURL, "/token?key="+f.apiKey, &req)
 	if err != nil {
 		return nil, err
 	}
 
-	if status != 200 {
-		if resp != nil {
-			return nil, fmt.Errorf("firebase returned http status %v. body: %v", status, string(resp))
-		} else {
-			return nil, fmt.Errorf("firebase returned http status %v", status)
-		}
+	if status != http.StatusOK {
+		return nil, newError(status, resp)
 	}
 
 	var token FBRefreshTokenResp
@@ -191,21 +291,43 @@ func (f *FirebaseAuth) RefreshToken(refreshToken string) (*FBRefreshTokenResp, e
 
 // GetRoleFromToken
 func (f *FirebaseAuth) GetRoleFromToken(idToken string) (string, error) {
-	token, err := f.client.VerifyIDToken(context.Background(), idToken)
+	return f.GetRoleFromTokenContext(context.Background(), idToken)
+}
+
+// GetRoleFromTokenContext
+func (f *FirebaseAuth) GetRoleFromTokenContext(ctx context.Context, idToken string) (string, error) {
+	token, err := f.verifyIDToken(ctx, idToken, false)
 	if err != nil {
 		return "", err
 	}
 
-	claims := token.Claims
-	if role, found := claims["role"]; found {
-		return role.(string), nil
-	} else {
-		return "", nil
+	return roleFromClaims(token.Claims), nil
+}
+
+// roleFromClaims returns the legacy single role, or the first entry of the multi-role claim
+func roleFromClaims(claims map[string]interface{}) string {
+	if role, ok := claims[RoleClaim].(string); ok {
+		return role
 	}
+
+	if roles := RolesFromClaims(claims); len(roles) > 0 {
+		return roles[0]
+	}
+
+	return ""
 }
 
 // CreateUser
 func (f *FirebaseAuth) CreateUser(email string, phone string, pwd string, name string, avatar string, verified bool, disabled bool) (string, error) {
+	return f.CreateUserContext(context.Background(), email, phone, pwd, name, avatar, verified, disabled)
+}
+
+// CreateUserContext
+func (f *FirebaseAuth) CreateUserContext(ctx context.Context, email string, phone string, pwd string, name string, avatar string, verified bool, disabled bool) (string, error) {
+	if err := f.checkPassword(ctx, pwd, email); err != nil {
+		return "", err
+	}
+
 	params := (&auth.UserToCreate{}).
 		Email(email).
 		EmailVerified(verified).
@@ -221,26 +343,26 @@ func (f *FirebaseAuth) CreateUser(email string, phone string, pwd string, name s
 		params = params.PhoneNumber(phone)
 	}
 
-	user, err := f.client.CreateUser(context.Background(), params)
+	user, err := f.client.CreateUser(ctx, params)
 
 	if err != nil {
 		return "", err
 	}
 
 	return user.UID, nil
-
-	/*
-		claims := map[string]interface{}{"role": "admin"}
-
-		err = f.client.SetCustomUserClaims(ctx, u.UID, claims)
-		if err != nil {
-			log.Fatalf("error setting custom claims %v\n", err)
-		}
-	*/
 }
 
-// UpdateUser
+// UpdateUser sets every field, so empty values clear or reject them. Use UpdateUserFields for partial updates.
 func (f *FirebaseAuth) UpdateUser(uid string, email string, pwd string, name string, avatar string, phone string, verified bool, disabled bool) error {
+	return f.UpdateUserContext(context.Background(), uid, email, pwd, name, avatar, phone, verified, disabled)
+}
+
+// UpdateUserContext sets every field, so empty values clear or reject them. Use UpdateUserFields for partial updates.
+func (f *FirebaseAuth) UpdateUserContext(ctx context.Context, uid string, email string, pwd string, name string, avatar string, phone string, verified bool, disabled bool) error {
+	if err := f.checkPassword(ctx, pwd, email); err != nil {
+		return err
+	}
+
 	params := (&auth.UserToUpdate{}).
 		Email(email).
 		EmailVerified(verified).
@@ -250,51 +372,68 @@ func (f *FirebaseAuth) UpdateUser(uid string, email string, pwd string, name str
 		PhotoURL(avatar).
 		Disabled(disabled)
 
-	if _, err := f.client.UpdateUser(context.Background(), uid, params); err != nil {
+	_, err := f.client.UpdateUser(ctx, uid, params)
+
+	// the full update always sets disabled, so only disabling it is worth an event
+	var disabledEvent *bool
+	if disabled {
+		disabledEvent = &disabled
+	}
+	f.auditUpdate(ctx, uid, true, false, disabledEvent, err)
+
+	if err != nil {
 		return err
 	}
 
+	if disabled {
+		f.invalidateCachedTokens(uid)
+	}
+
 	return nil
 }
 
 // UpdateUserEmail
 func (f *FirebaseAuth) UpdateUserEmail(uid string, email string) error {
-	params := (&auth.UserToUpdate{}).
-		Email(email)
-
-	if _, err := f.client.UpdateUser(context.Background(), uid, params); err != nil {
-		return err
-	}
+	return f.UpdateUserEmailContext(context.Background(), uid, email)
+}
 
-	return nil
+// UpdateUserEmailContext
+func (f *FirebaseAuth) UpdateUserEmailContext(ctx context.Context, uid string, email string) error {
+	_, err := f.UpdateUserFields(ctx, uid, &UserUpdate{Email: String(email)})
+	return err
 }
 
 // UpdateUserPassword
 func (f *FirebaseAuth) UpdateUserPassword(uid string, password string) error {
-	params := (&auth.UserToUpdate{}).
-		Password(password)
-
-	if _, err := f.client.UpdateUser(context.Background(), uid, params); err != nil {
-		return err
-	}
+	return f.UpdateUserPasswordContext(context.Background(), uid, password)
+}
 
-	return nil
+// UpdateUserPasswordContext
+func (f *FirebaseAuth) UpdateUserPasswordContext(ctx context.Context, uid string, password string) error {
+	_, err := f.UpdateUserFields(ctx, uid, &UserUpdate{Password: String(password)})
+	return err
 }
 
 func (f *FirebaseAuth) UpdateUserDisabled(uid string, disabled bool) error {
-	params := (&auth.UserToUpdate{}).
-		Disabled(disabled)
-
-	if _, err := f.client.UpdateUser(context.Background(), uid, params); err != nil {
-		return err
-	}
+	return f.UpdateUserDisabledContext(context.Background(), uid, disabled)
+}
 
-	return nil
+// UpdateUserDisabledContext
+func (f *FirebaseAuth) UpdateUserDisabledContext(ctx context.Context, uid string, disabled bool) error {
+	_, err := f.UpdateUserFields(ctx, uid, &UserUpdate{Disabled: Bool(disabled)})
+	return err
 }
 
 // ResetPasswordLink
 func (f *FirebaseAuth) ResetPasswordLink(email string) (string, error) {
-	link, err := f.client.PasswordResetLink(context.Background(), email)
+	return f.ResetPasswordLinkContext(context.Background(), email)
+}
+
+// ResetPasswordLinkContext
+func (f *FirebaseAuth) ResetPasswordLinkContext(ctx context.Context, email string) (string, error) {
+	link, err := f.client.PasswordResetLink(ctx, email)
+	f.audit(ctx, &AuditEvent{Type: AuditPasswordResetLink, Details: map[string]interface{}{"email": email}}, err)
+
 	if err != nil {
 		return "", err
 	}
@@ -304,8 +443,13 @@ func (f *FirebaseAuth) ResetPasswordLink(email string) (string, error) {
 
 // CheckUserExists
 func (f *FirebaseAuth) CheckUserExists(email string) (bool, error) {
-	if user, err := f.client.GetUserByEmail(context.Background(), email); err != nil {
-		if strings.Contains(err.Error(), "no user exists") {
+	return f.CheckUserExistsContext(context.Background(), email)
+}
+
+// CheckUserExistsContext
+func (f *FirebaseAuth) CheckUserExistsContext(ctx context.Context, email string) (bool, error) {
+	if user, err := f.client.GetUserByEmail(ctx, email); err != nil {
+		if auth.IsUserNotFound(err) {
 			return false, nil
 		} else {
 			return false, err
@@ -320,37 +464,68 @@ func (f *FirebaseAuth) CheckUserExists(email string) (bool, error) {
 }
 
 func (f *FirebaseAuth) VerifyToken(idToken string) (*auth.Token, error) {
-	return f.client.VerifyIDToken(context.Background(), idToken)
+	return f.VerifyTokenContext(context.Background(), idToken)
+}
+
+func (f *FirebaseAuth) VerifyTokenContext(ctx context.Context, idToken string) (*auth.Token, error) {
+	return f.verifyIDToken(ctx, idToken, false)
 }
 
 func (f *FirebaseAuth) CreateToken(uid string, claims map[string]interface{}) (string, error) {
+	return f.CreateTokenContext(context.Background(), uid, claims)
+}
+
+func (f *FirebaseAuth) CreateTokenContext(ctx context.Context, uid string, claims map[string]interface{}) (string, error) {
 	if claims == nil {
-		return f.client.CustomToken(context.Background(), uid)
+		return f.client.CustomToken(ctx, uid)
 	} else {
-		return f.client.CustomTokenWithClaims(context.Background(), uid, claims)
+		return f.client.CustomTokenWithClaims(ctx, uid, claims)
 	}
 }
 
-// submitPost
-func submitPost(baseURL string, path string, data []byte) ([]byte, int, error) {
-	resp, err := http.Post(baseURL+path, contentTypeJSON, bytes.NewBuffer(data))
+// postJSON sends req to an identitytoolkit endpoint and decodes the response into resp.
+// Error responses are returned as *Error.
+func (f *FirebaseAuth) postJSON(ctx context.Context, path string, req interface{}, resp interface{}) error {
+	if body, ok := req.(map[string]interface{}); ok && f.tenantID != "" {
+		body["tenantId"] = f.tenantID
+	}
+
+	data, err := json.Marshal(req)
 	if err != nil {
-		return nil, 0, err
+		return err
 	}
 
-	defer resp.Body.Close()
+	body, status, err := f.submitPost(ctx, f.baseURL, path+"?key="+f.apiKey, data)
+	if err != nil {
+		return err
+	}
 
-	if bodyBytes, err := ioutil.ReadAll(resp.Body); err != nil {
+	if status != http.StatusOK {
+		return newError(status, body)
+	}
+
+	if resp == nil {
+		return nil
+	}
+
+	return json.Unmarshal(body, resp)
+}
+
+// submitPost
+func (f *FirebaseAuth) submitPost(ctx context.Context, baseURL string, path string, data []byte) ([]byte, int, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+path, bytes.NewBuffer(data))
+	if err != nil {
 		return nil, 0, err
-	} else {
-		return bodyBytes, resp.StatusCode, nil
 	}
+
+	r.Header.Add("Content-Type", contentTypeJSON)
+
+	return f.submit(r)
 }
 
 // submitForm
-func submitForm(baseURL string, path string, data *url.Values) ([]byte, int, error) {
-	client := &http.Client{}
-	r, err := http.NewRequest("POST", baseURL+path, strings.NewReader(data.Encode())) // URL-encoded payload
+func (f *FirebaseAuth) submitForm(ctx context.Context, baseURL string, path string, data *url.Values) ([]byte, int, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+path, strings.NewReader(data.Encode())) // URL-encoded payload
 	if err != nil {
 		return nil, 0, err
 	}
@@ -358,7 +533,12 @@ func submitForm(baseURL string, path string, data *url.Values) ([]byte, int, err
 	r.Header.Add("Content-Type", contentTypeForm)
 	r.Header.Add("Content-Length", strconv.Itoa(len(data.Encode())))
 
-	resp, err := client.Do(r)
+	return f.submit(r)
+}
+
+// submit sends the request with the configured http.Client and returns the body and status code
+func (f *FirebaseAuth) submit(r *http.Request) ([]byte, int, error) {
+	resp, err := f.httpClient.Do(r)
 	if err != nil {
 		return nil, 0, err
 	}
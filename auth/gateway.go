@@ -0,0 +1,304 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// Headers set by ESP/ESPv2 (Cloud Endpoints) and API Gateway after they have validated the caller's JWT.
+// They can only be trusted when the service is not reachable except through the proxy.
+const (
+	EndpointUserInfoHeader = "X-Endpoint-API-UserInfo"
+	GatewayUserInfoHeader  = "X-Apigateway-Api-Userinfo"
+)
+
+var ErrMissingUserInfo = errors.New("missing user info header")
+
+// WithTokenFallback verifies the bearer token with f when the user info header is missing,
+// e.g. when running locally without a gateway in front of the service
+func WithTokenFallback(f *FirebaseAuth) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.fallback = f
+	}
+}
+
+// DecodeEndpointUser decodes the base64url encoded X-Endpoint-API-UserInfo header.
+// ESP sends {"id", "issuer", "email", "claims"} with the JWT claims as a JSON string,
+// while ESPv2 forwards the JWT payload itself. Both forms are accepted.
+func DecodeEndpointUser(header string) (*EndpointUser, error) {
+	data, err := decodeUserInfo(header)
+	if err != nil {
+		return nil, err
+	}
+
+	var user EndpointUser
+	if err = json.Unmarshal(data, &user); err != nil {
+		return nil, fmt.Errorf("invalid endpoint user info: %v", err)
+	}
+
+	var claims map[string]interface{}
+	if err = json.Unmarshal(data, &claims); err != nil {
+		return nil, fmt.Errorf("invalid endpoint user info: %v", err)
+	}
+
+	if nested, ok := claims["claims"].(string); ok {
+		var inner map[string]interface{}
+		if err = json.Unmarshal([]byte(nested), &inner); err != nil {
+			return nil, fmt.Errorf("invalid endpoint user claims: %v", err)
+		}
+		claims = inner
+	}
+
+	if err = fillEndpointUser(&user, claims); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// DecodeGatewayUser decodes the base64url encoded X-Apigateway-Api-Userinfo header
+func DecodeGatewayUser(header string) (*GatewayUser, error) {
+	data, err := decodeUserInfo(header)
+	if err != nil {
+		return nil, err
+	}
+
+	var user GatewayUser
+	if err = json.Unmarshal(data, &user); err != nil {
+		return nil, fmt.Errorf("invalid gateway user info: %v", err)
+	}
+
+	if err = json.Unmarshal(data, &user.Claims); err != nil {
+		return nil, fmt.Errorf("invalid gateway user info: %v", err)
+	}
+
+	return &user, nil
+}
+
+// EndpointUserFromRequest decodes the Cloud Endpoints user info header of r
+func EndpointUserFromRequest(r *http.Request) (*EndpointUser, error) {
+	header := r.Header.Get(EndpointUserInfoHeader)
+	if header == "" {
+		return nil, ErrMissingUserInfo
+	}
+
+	return DecodeEndpointUser(header)
+}
+
+// GatewayUserFromRequest decodes the API Gateway user info header of r
+func GatewayUserFromRequest(r *http.Request) (*GatewayUser, error) {
+	header := r.Header.Get(GatewayUserInfoHeader)
+	if header == "" {
+		return nil, ErrMissingUserInfo
+	}
+
+	return DecodeGatewayUser(header)
+}
+
+// EndpointUserFromContext returns the EndpointUser stored by EndpointMiddleware
+func EndpointUserFromContext(ctx context.Context) (*EndpointUser, bool) {
+	user, ok := ctx.Value(endpointUserKey).(*EndpointUser)
+	return user, ok && user != nil
+}
+
+// GatewayUserFromContext returns the GatewayUser stored by GatewayMiddleware
+func GatewayUserFromContext(ctx context.Context) (*GatewayUser, bool) {
+	user, ok := ctx.Value(gatewayUserKey).(*GatewayUser)
+	return user, ok && user != nil
+}
+
+// EndpointMiddleware decodes X-Endpoint-API-UserInfo and stores the EndpointUser and its Principal in the request context
+func EndpointMiddleware(opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	cfg := newMiddlewareConfig(opts)
+
+	return userInfoMiddleware(cfg, EndpointUserInfoHeader, func(ctx context.Context, header string, token *auth.Token) (context.Context, error) {
+		var user *EndpointUser
+		var err error
+
+		if token != nil {
+			user = &EndpointUser{}
+			err = fillEndpointUser(user, tokenClaims(token))
+		} else {
+			user, err = DecodeEndpointUser(header)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		ctx = NewContext(ctx, PrincipalFromEndpointUser(user))
+		return context.WithValue(ctx, endpointUserKey, user), nil
+	})
+}
+
+// GatewayMiddleware decodes X-Apigateway-Api-Userinfo and stores the GatewayUser and its Principal in the request context
+func GatewayMiddleware(opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	cfg := newMiddlewareConfig(opts)
+
+	return userInfoMiddleware(cfg, GatewayUserInfoHeader, func(ctx context.Context, header string, token *auth.Token) (context.Context, error) {
+		var user *GatewayUser
+		var err error
+
+		if token != nil {
+			user, err = gatewayUserFromClaims(tokenClaims(token))
+		} else {
+			user, err = DecodeGatewayUser(header)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		ctx = NewContext(ctx, PrincipalFromGatewayUser(user))
+		return context.WithValue(ctx, gatewayUserKey, user), nil
+	})
+}
+
+// userInfoMiddleware handles the header lookup, token fallback and tenant check shared by the gateway
+// middlewares. store receives either the raw header or, when falling back, the verified token, and
+// must put the Principal in the context it returns.
+func userInfoMiddleware(cfg *middlewareConfig, header string,
+	store func(ctx context.Context, header string, token *auth.Token) (context.Context, error)) func(http.Handler) http.Handler {
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			value := r.Header.Get(header)
+
+			var token *auth.Token
+			if value == "" {
+				idToken := ""
+				if cfg.fallback != nil {
+					idToken = BearerToken(r)
+				}
+
+				if idToken == "" {
+					if cfg.isOptional(r) {
+						next.ServeHTTP(w, r)
+					} else {
+						cfg.errorHandler(w, r, ErrMissingUserInfo)
+					}
+					return
+				}
+
+				var err error
+				if token, err = cfg.fallback.verifyIDToken(r.Context(), idToken, cfg.checkRevoked); err != nil {
+					cfg.errorHandler(w, r, fmt.Errorf("%w: %w", ErrInvalidToken, err))
+					return
+				}
+			}
+
+			ctx, err := store(r.Context(), value, token)
+			if err != nil {
+				cfg.errorHandler(w, r, err)
+				return
+			}
+
+			if p, _ := FromContext(ctx); cfg.tenantID != "" && (p == nil || p.Tenant != cfg.tenantID) {
+				cfg.errorHandler(w, r, ErrTenantMismatch)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// decodeUserInfo accepts padded or unpadded base64url, and falls back to standard base64
+func decodeUserInfo(header string) ([]byte, error) {
+	header = strings.TrimSpace(header)
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(header, "="))
+	if err != nil {
+		if data, err = base64.StdEncoding.DecodeString(header); err != nil {
+			return nil, fmt.Errorf("invalid user info encoding: %v", err)
+		}
+	}
+
+	return data, nil
+}
+
+// fillEndpointUser fills the fields ESPv2 and the token fallback leave empty from the JWT claims
+func fillEndpointUser(user *EndpointUser, claims map[string]interface{}) error {
+	user.Claims = claims
+
+	if user.UID == "" {
+		if sub, ok := claims["sub"].(string); ok {
+			user.UID = sub
+		} else if uid, ok := claims["user_id"].(string); ok {
+			user.UID = uid
+		}
+	}
+	if user.Issuer == "" {
+		user.Issuer, _ = claims["iss"].(string)
+	}
+	if user.Email == "" {
+		user.Email, _ = claims["email"].(string)
+	}
+	if len(user.Audiences) == 0 {
+		switch aud := claims["aud"].(type) {
+		case string:
+			user.Audiences = []string{aud}
+		case []interface{}:
+			for _, a := range aud {
+				if s, ok := a.(string); ok {
+					user.Audiences = append(user.Audiences, s)
+				}
+			}
+		}
+	}
+
+	if fb, ok := claims["firebase"]; ok {
+		data, err := json.Marshal(fb)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(data, &user.Firebase); err != nil {
+			return fmt.Errorf("invalid firebase claim: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// gatewayUserFromClaims
+func gatewayUserFromClaims(claims map[string]interface{}) (*GatewayUser, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	var user GatewayUser
+	if err = json.Unmarshal(data, &user); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %v", err)
+	}
+	user.Claims = claims
+
+	return &user, nil
+}
+
+// tokenClaims rebuilds the full JWT claim set, as the Admin SDK strips the registered claims out of Token.Claims
+func tokenClaims(token *auth.Token) map[string]interface{} {
+	claims := make(map[string]interface{}, len(token.Claims)+5)
+	for k, v := range token.Claims {
+		claims[k] = v
+	}
+
+	claims["iss"] = token.Issuer
+	claims["aud"] = token.Audience
+	claims["exp"] = token.Expires
+	claims["iat"] = token.IssuedAt
+	claims["sub"] = token.Subject
+
+	return claims
+}
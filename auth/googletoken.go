@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GoogleCertsURL serves the keys Google signs OIDC ID tokens with, e.g. those Cloud Tasks and
+// Pub/Sub push subscriptions attach for a service account
+const GoogleCertsURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// ErrCallerNotAllowed is returned for a valid Google ID token of a service account that is not allowed
+var ErrCallerNotAllowed = errors.New("caller not allowed")
+
+// googleIssuers are the two issuer forms Google uses in ID tokens
+var googleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+// googleKeys is shared by verifiers without their own KeySource, so the certificates are fetched once
+var googleKeys = NewRemoteKeys(GoogleCertsURL, nil)
+
+// GoogleIdentity is the verified caller of a Google-signed ID token
+type GoogleIdentity struct {
+	Subject         string
+	Email           string
+	EmailVerified   bool
+	Audience        string // the audience that matched
+	AuthorizedParty string // azp, the client the token was issued to
+	IssuedAt        time.Time
+	Expires         time.Time
+	Claims          map[string]interface{}
+}
+
+// GoogleTokenConfig configures a GoogleTokenVerifier
+type GoogleTokenConfig struct {
+	// Audiences accepted in the aud claim. Cloud Tasks and Pub/Sub use the target URL unless an
+	// audience is set on the task or subscription. Required.
+	Audiences []string
+
+	// ServiceAccounts lists the emails allowed to call, e.g. the service account the queue or
+	// subscription sends tokens for. Required unless AllowAnyServiceAccount is set.
+	ServiceAccounts []string
+
+	// AllowAnyServiceAccount accepts a token from any Google account. Any service account in any
+	// project can mint a token for our audience, so only set it when the audience alone is enough.
+	AllowAnyServiceAccount bool
+
+	// Keys defaults to Google's published certificates, cached for their max-age
+	Keys KeySource
+}
+
+// GoogleTokenVerifier verifies Google-signed OIDC ID tokens on Cloud Tasks and Pub/Sub push requests
+type GoogleTokenVerifier struct {
+	audiences []string
+	emails    map[string]struct{}
+	keys      KeySource
+	skew      time.Duration
+	now       func() time.Time
+}
+
+// NewGoogleTokenVerifier
+func NewGoogleTokenVerifier(cfg GoogleTokenConfig) (*GoogleTokenVerifier, error) {
+	if len(cfg.Audiences) == 0 {
+		return nil, errors.New("google token verifier needs at least one audience")
+	}
+	if len(cfg.ServiceAccounts) == 0 && !cfg.AllowAnyServiceAccount {
+		return nil, errors.New("google token verifier needs service accounts, or AllowAnyServiceAccount")
+	}
+
+	v := &GoogleTokenVerifier{
+		audiences: cfg.Audiences,
+		emails:    make(map[string]struct{}, len(cfg.ServiceAccounts)),
+		keys:      cfg.Keys,
+		skew:      defaultClockSkew,
+		now:       time.Now,
+	}
+
+	if v.keys == nil {
+		v.keys = googleKeys
+	}
+	for _, email := range cfg.ServiceAccounts {
+		v.emails[strings.ToLower(email)] = struct{}{}
+	}
+
+	return v, nil
+}
+
+// SetClock replaces time.Now, for tests
+func (v *GoogleTokenVerifier) SetClock(now func() time.Time) {
+	v.now = now
+}
+
+// Verify checks the signature, issuer, audience, expiry and caller email of token
+func (v *GoogleTokenVerifier) Verify(ctx context.Context, token string) (*GoogleIdentity, error) {
+	t, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := v.keys.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.verifyWithKeys(keys); err != nil {
+		return nil, err
+	}
+
+	if iss := t.str("iss"); !contains(googleIssuers, iss) {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, iss)
+	}
+	if err = t.checkTimes(v.now(), v.skew); err != nil {
+		return nil, err
+	}
+
+	identity := &GoogleIdentity{
+		Subject:         t.str("sub"),
+		Email:           t.str("email"),
+		AuthorizedParty: t.str("azp"),
+		IssuedAt:        t.time("iat"),
+		Expires:         t.time("exp"),
+		Claims:          t.claims,
+	}
+	identity.EmailVerified, _ = t.claims["email_verified"].(bool)
+
+	for _, aud := range v.audiences {
+		if t.hasAudience(aud) {
+			identity.Audience = aud
+			break
+		}
+	}
+	if identity.Audience == "" {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+
+	if len(v.emails) > 0 {
+		if !identity.EmailVerified {
+			return nil, fmt.Errorf("%w: email not verified", ErrCallerNotAllowed)
+		}
+		if _, ok := v.emails[strings.ToLower(identity.Email)]; !ok {
+			return nil, fmt.Errorf("%w: %v", ErrCallerNotAllowed, identity.Email)
+		}
+	}
+
+	return identity, nil
+}
+
+// Middleware rejects requests without a valid bearer token from an allowed caller and stores the
+// GoogleIdentity in the request context. WithOptional, WithOptionalPaths and WithErrorHandler apply.
+// The default error handler answers 401, or 403 for a valid token from a caller that is not allowed.
+func (v *GoogleTokenVerifier) Middleware(opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	cfg := newMiddlewareConfig(append([]MiddlewareOption{WithErrorHandler(googleErrorHandler)}, opts...))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := BearerToken(r)
+
+			if token == "" {
+				if cfg.isOptional(r) {
+					next.ServeHTTP(w, r)
+				} else {
+					cfg.errorHandler(w, r, ErrMissingToken)
+				}
+				return
+			}
+
+			identity, err := v.Verify(r.Context(), token)
+			if err != nil {
+				cfg.errorHandler(w, r, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), googleIdentityKey, identity)))
+		})
+	}
+}
+
+// GoogleIdentityFromContext returns the GoogleIdentity stored by GoogleTokenVerifier.Middleware
+func GoogleIdentityFromContext(ctx context.Context) (*GoogleIdentity, bool) {
+	identity, ok := ctx.Value(googleIdentityKey).(*GoogleIdentity)
+	return identity, ok && identity != nil
+}
+
+// googleErrorHandler
+func googleErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrCallerNotAllowed) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	defaultErrorHandler(w, r, err)
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// jwt is a decoded, not yet verified, RS256 JSON Web Token
+type jwt struct {
+	header    jwtHeader
+	claims    map[string]interface{}
+	signed    string // header.payload, the signing input
+	signature []byte
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// parseJWT decodes a compact serialized JWT without verifying it
+func parseJWT(token string) (*jwt, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: token must have 3 segments", ErrInvalidToken)
+	}
+
+	t := &jwt{signed: parts[0] + "." + parts[1]}
+
+	if err := decodeSegment(parts[0], &t.header); err != nil {
+		return nil, fmt.Errorf("%w: invalid header: %v", ErrInvalidToken, err)
+	}
+	if err := decodeSegment(parts[1], &t.claims); err != nil {
+		return nil, fmt.Errorf("%w: invalid payload: %v", ErrInvalidToken, err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid signature encoding: %v", ErrInvalidToken, err)
+	}
+	t.signature = sig
+
+	return t, nil
+}
+
+// verify checks the RS256 signature against key
+func (t *jwt) verify(key *rsa.PublicKey) error {
+	if t.header.Alg != "RS256" {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, t.header.Alg)
+	}
+
+	digest := sha256.Sum256([]byte(t.signed))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], t.signature); err != nil {
+		return fmt.Errorf("%w: invalid signature", ErrInvalidToken)
+	}
+
+	return nil
+}
+
+// verifyWithKeys looks up the signing key by kid and verifies the signature
+func (t *jwt) verifyWithKeys(keys map[string]*rsa.PublicKey) error {
+	if t.header.Kid == "" {
+		return fmt.Errorf("%w: missing kid header", ErrInvalidToken)
+	}
+
+	key, ok := keys[t.header.Kid]
+	if !ok {
+		return fmt.Errorf("%w: unknown signing key %q", ErrInvalidToken, t.header.Kid)
+	}
+
+	return t.verify(key)
+}
+
+// str returns a string claim
+func (t *jwt) str(name string) string {
+	s, _ := t.claims[name].(string)
+	return s
+}
+
+// num returns a numeric claim, or 0
+func (t *jwt) num(name string) int64 {
+	v, _ := t.claims[name].(float64)
+	return int64(v)
+}
+
+// time returns a NumericDate claim
+func (t *jwt) time(name string) time.Time {
+	if v, ok := t.claims[name].(float64); ok {
+		return time.Unix(int64(v), 0)
+	}
+
+	return time.Time{}
+}
+
+// hasAudience accepts both the string and array forms of aud
+func (t *jwt) hasAudience(audience string) bool {
+	switch aud := t.claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// checkTimes validates exp and iat with the given clock skew allowance
+func (t *jwt) checkTimes(now time.Time, skew time.Duration) error {
+	exp := t.time("exp")
+	if exp.IsZero() {
+		return fmt.Errorf("%w: missing exp claim", ErrInvalidToken)
+	}
+	if !now.Before(exp.Add(skew)) {
+		return fmt.Errorf("%w: expired at %v", ErrTokenExpired, exp)
+	}
+
+	if iat := t.time("iat"); !iat.IsZero() && iat.After(now.Add(skew)) {
+		return fmt.Errorf("%w: issued in the future", ErrInvalidToken)
+	}
+
+	return nil
+}
+
+// signJWT creates an RS256 signed JWT
+func signJWT(key *rsa.PrivateKey, kid string, claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: "RS256", Kid: kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// decodeSegment
+func decodeSegment(segment string, dest interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, dest)
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecureTokenCertsURL serves the certificates Firebase ID tokens and blocking function events are signed with
+const SecureTokenCertsURL = "https://www.googleapis.com/robot/v1/metadata/x509/securetoken@system.gserviceaccount.com"
+
+// defaultKeysMaxAge is used when the key endpoint sends no Cache-Control max-age
+const defaultKeysMaxAge = time.Hour
+
+// KeySource provides the RSA public keys used to verify token signatures, by key ID
+type KeySource interface {
+	Keys(ctx context.Context) (map[string]*rsa.PublicKey, error)
+}
+
+// StaticKeys is a fixed KeySource, e.g. for tests and air-gapped environments
+type StaticKeys map[string]*rsa.PublicKey
+
+// Keys
+func (s StaticKeys) Keys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	return s, nil
+}
+
+// RemoteKeys fetches keys from a URL serving either a JSON Web Key Set or a map of PEM certificates,
+// and caches them for the max-age the endpoint sends. It is safe for concurrent use.
+type RemoteKeys struct {
+	url    string
+	client *http.Client
+	now    func() time.Time
+
+	mu     sync.Mutex
+	keys   StaticKeys
+	expiry time.Time
+}
+
+// NewRemoteKeys uses http.DefaultClient when client is nil
+func NewRemoteKeys(url string, client *http.Client) *RemoteKeys {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &RemoteKeys{
+		url:    url,
+		client: client,
+		now:    time.Now,
+	}
+}
+
+// Keys returns the cached keys, fetching them again once they have expired
+func (k *RemoteKeys) Keys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.keys != nil && k.now().Before(k.expiry) {
+		return k.keys, nil
+	}
+
+	keys, maxAge, err := k.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	k.keys = keys
+	k.expiry = k.now().Add(maxAge)
+
+	return keys, nil
+}
+
+// fetch downloads and parses the keys
+func (k *RemoteKeys) fetch(ctx context.Context) (StaticKeys, time.Duration, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, k.url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := k.client.Do(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("fetching keys from %v returned http status %v", k.url, resp.StatusCode)
+	}
+
+	var keys StaticKeys
+	if strings.Contains(string(data), `"keys"`) {
+		keys, err = ParseJWKS(data)
+	} else {
+		keys, err = ParseX509Keys(data)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return keys, maxAge(resp.Header.Get("Cache-Control")), nil
+}
+
+// maxAge reads max-age from a Cache-Control header
+func maxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(directive), "=")
+		if !ok || !strings.EqualFold(name, "max-age") {
+			continue
+		}
+
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	return defaultKeysMaxAge
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// ParseJWKS reads the RSA keys of a JSON Web Key Set. Other key types are skipped.
+func ParseJWKS(data []byte) (StaticKeys, error) {
+	var set jwks
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid jwks: %v", err)
+	}
+
+	keys := StaticKeys{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus for key %q: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent for key %q: %v", k.Kid, err)
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("jwks contains no RSA signing keys")
+	}
+
+	return keys, nil
+}
+
+// ParseX509Keys reads a JSON object mapping key IDs to PEM certificates or public keys,
+// the format Google publishes the Firebase token signing certificates in
+func ParseX509Keys(data []byte) (StaticKeys, error) {
+	var certs map[string]string
+	if err := json.Unmarshal(data, &certs); err != nil {
+		return nil, fmt.Errorf("invalid certificate set: %v", err)
+	}
+
+	keys := StaticKeys{}
+	for kid, cert := range certs {
+		key, err := ParsePEMPublicKey([]byte(cert))
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", kid, err)
+		}
+		keys[kid] = key
+	}
+
+	return keys, nil
+}
+
+// ParsePEMPublicKey reads an RSA public key from a PEM certificate, PKIX public key or PKCS#1 public key
+func ParsePEMPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var pub interface{}
+	var err error
+
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			pub = cert.PublicKey
+		}
+	case "PUBLIC KEY":
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+
+	return key, nil
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// lockoutLevelDecay is how long a repeat offender keeps its backoff level after the last lockout
+const lockoutLevelDecay = 24 * time.Hour
+
+// Lockout scopes
+const (
+	LockoutEmail = "email"
+	LockoutIP    = "ip"
+)
+
+var ErrLockedOut = errors.New("too many failed logins")
+
+// LockedOutError is returned by Login while an email or client IP is locked out. It matches ErrLockedOut.
+type LockedOutError struct {
+	Scope      string // LockoutEmail or LockoutIP
+	RetryAfter time.Duration
+}
+
+func (e *LockedOutError) Error() string {
+	return fmt.Sprintf("too many failed logins for this %v, retry after %v", e.Scope, e.RetryAfter.Round(time.Second))
+}
+
+// Is
+func (e *LockedOutError) Is(target error) bool {
+	return target == ErrLockedOut
+}
+
+// LoginAttempt describes a failed login passed to the OnFailure hook
+type LoginAttempt struct {
+	Email         string
+	IP            string
+	EmailFailures int // failures for this email within the window
+	IPFailures    int // failures for this IP within the window
+	Err           error
+}
+
+// Lockout describes a new lockout passed to the OnLockout hook
+type Lockout struct {
+	Scope    string // LockoutEmail or LockoutIP
+	Subject  string // the email or IP
+	Level    int    // 1 for the first lockout, increasing for repeats
+	Duration time.Duration
+}
+
+// LoginGuardConfig configures a LoginGuard. Zero values take the defaults noted below.
+type LoginGuardConfig struct {
+	MaxEmailFailures int           // failures per email before a lockout, default 5
+	MaxIPFailures    int           // failures per client IP before a lockout, default 20
+	Window           time.Duration // how long failures are remembered, default 15 minutes
+	BaseLockout      time.Duration // first lockout, doubled on each repeat, default 1 minute
+	MaxLockout       time.Duration // longest lockout, default 1 hour
+	KeyPrefix        string        // Store key prefix, default "loginguard:"
+
+	// Hooks for alerting. They run synchronously inside Login, so keep them fast.
+	OnFailure func(ctx context.Context, attempt LoginAttempt)
+	OnLockout func(ctx context.Context, lockout Lockout)
+}
+
+// LoginGuard tracks failed logins per email and client IP and locks them out with exponential backoff
+type LoginGuard struct {
+	store Store
+	cfg   LoginGuardConfig
+}
+
+// WithLoginGuard enables brute-force protection in Login. The client IP is read from the
+// context, see ContextWithClientIP.
+func WithLoginGuard(g *LoginGuard) Option {
+	return func(f *FirebaseAuth) {
+		f.guard = g
+	}
+}
+
+// NewLoginGuard keeps its counters in store, e.g. a *storage.MemStore or a *LocalStore
+func NewLoginGuard(store Store, cfg LoginGuardConfig) *LoginGuard {
+	if cfg.MaxEmailFailures <= 0 {
+		cfg.MaxEmailFailures = 5
+	}
+	if cfg.MaxIPFailures <= 0 {
+		cfg.MaxIPFailures = 20
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = 15 * time.Minute
+	}
+	if cfg.BaseLockout <= 0 {
+		cfg.BaseLockout = time.Minute
+	}
+	if cfg.MaxLockout <= 0 {
+		cfg.MaxLockout = time.Hour
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = "loginguard:"
+	}
+
+	return &LoginGuard{
+		store: store,
+		cfg:   cfg,
+	}
+}
+
+// Check returns a *LockedOutError if the email or IP is currently locked out
+func (g *LoginGuard) Check(ctx context.Context, email string, ip string) error {
+	for _, s := range g.subjects(email, ip) {
+		var until int64
+		if err := g.store.GetKey(g.key("lock", s.scope, s.id), &until); err != nil {
+			continue
+		}
+
+		if wait := time.Until(time.Unix(0, until)); wait > 0 {
+			return &LockedOutError{Scope: s.scope, RetryAfter: wait}
+		}
+	}
+
+	return nil
+}
+
+// RecordFailure counts a failed login and starts a lockout once a limit is reached.
+// Only credential errors count; outages and rate limiting on Firebase's side do not.
+// An error means the store could not count the failure, so no lockout could start.
+func (g *LoginGuard) RecordFailure(ctx context.Context, email string, ip string, err error) error {
+	if !isCredentialError(err) {
+		return nil
+	}
+
+	attempt := LoginAttempt{Email: email, IP: ip, Err: err}
+	var errs []error
+
+	for _, s := range g.subjects(email, ip) {
+		failKey := g.key("fail", s.scope, s.id)
+		count, ok := g.store.IncrementAndExpire(failKey, 0, g.cfg.Window.Seconds())
+		if !ok {
+			errs = append(errs, fmt.Errorf("failed to count login failure for %v", s.scope))
+			continue
+		}
+
+		limit := g.cfg.MaxEmailFailures
+		if s.scope == LockoutEmail {
+			attempt.EmailFailures = count
+		} else {
+			attempt.IPFailures = count
+			limit = g.cfg.MaxIPFailures
+		}
+
+		if count >= limit {
+			if err := g.lock(ctx, s, failKey); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if g.cfg.OnFailure != nil {
+		g.cfg.OnFailure(ctx, attempt)
+	}
+
+	return errors.Join(errs...)
+}
+
+// RecordSuccess clears the failure count and lockout state of the email, and the failure count of the IP
+func (g *LoginGuard) RecordSuccess(ctx context.Context, email string, ip string) {
+	for _, s := range g.subjects(email, ip) {
+		g.store.DeleteKey(g.key("fail", s.scope, s.id))
+
+		if s.scope == LockoutEmail {
+			g.store.DeleteKey(g.key("lock", s.scope, s.id))
+			g.store.DeleteKey(g.key("level", s.scope, s.id))
+		}
+	}
+}
+
+// lock starts a lockout twice as long as the previous one for this subject. When the level cannot be
+// counted the lockout still starts, at the first level, and the error is returned.
+func (g *LoginGuard) lock(ctx context.Context, s guardSubject, failKey string) error {
+	var err error
+
+	level, ok := g.store.IncrementAndExpire(g.key("level", s.scope, s.id), 0, lockoutLevelDecay.Seconds())
+	if !ok || level < 1 {
+		err = fmt.Errorf("failed to count lockout level for %v", s.scope)
+		level = 1
+	}
+
+	duration := time.Duration(float64(g.cfg.BaseLockout) * math.Pow(2, float64(level-1)))
+	if duration > g.cfg.MaxLockout || duration <= 0 {
+		duration = g.cfg.MaxLockout
+	}
+
+	until := time.Now().Add(duration)
+	if !g.store.SaveKey(g.key("lock", s.scope, s.id), until.UnixNano(), int(math.Ceil(duration.Seconds()))) {
+		return fmt.Errorf("failed to save lockout for %v", s.scope)
+	}
+	g.store.DeleteKey(failKey)
+
+	if g.cfg.OnLockout != nil {
+		g.cfg.OnLockout(ctx, Lockout{Scope: s.scope, Subject: s.display, Level: level, Duration: duration})
+	}
+
+	return err
+}
+
+type guardSubject struct {
+	scope   string
+	id      string // hashed for emails so addresses are not stored in plain text
+	display string
+}
+
+// subjects
+func (g *LoginGuard) subjects(email string, ip string) []guardSubject {
+	var subjects []guardSubject
+
+	if email != "" {
+		sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+		subjects = append(subjects, guardSubject{scope: LockoutEmail, id: hex.EncodeToString(sum[:]), display: email})
+	}
+	if ip != "" {
+		subjects = append(subjects, guardSubject{scope: LockoutIP, id: ip, display: ip})
+	}
+
+	return subjects
+}
+
+// key
+func (g *LoginGuard) key(kind string, scope string, id string) string {
+	return g.cfg.KeyPrefix + kind + ":" + scope + ":" + id
+}
+
+// isCredentialError
+func isCredentialError(err error) bool {
+	return errors.Is(err, ErrInvalidPassword) || errors.Is(err, ErrEmailNotFound) || errors.Is(err, ErrInvalidLoginCredentials)
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+var (
+	ErrMissingToken = errors.New("missing id token")
+	ErrInvalidToken = errors.New("invalid id token")
+)
+
+type contextKey int
+
+const (
+	principalKey contextKey = iota
+	endpointUserKey
+	gatewayUserKey
+	clientIPKey
+	googleIdentityKey
+	userAgentKey
+	actorKey
+)
+
+// ErrorHandler writes the response for a request that failed authentication
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+// MiddlewareOption configures the auth middleware
+type MiddlewareOption func(*middlewareConfig)
+
+type middlewareConfig struct {
+	cookieName    string
+	optional      bool
+	optionalPaths []string
+	checkRevoked  bool
+	errorHandler  ErrorHandler
+	fallback      *FirebaseAuth
+	tenantID      string
+	trustGateway  bool
+	trustEndpoint bool
+	apiKeys       *APIKeyManager
+}
+
+// WithCookie reads the token from the named cookie when there is no Authorization header
+func WithCookie(name string) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.cookieName = name
+	}
+}
+
+// WithOptional lets requests without a token through without a Principal. Invalid tokens are still rejected.
+func WithOptional() MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.optional = true
+	}
+}
+
+// WithOptionalPaths behaves like WithOptional for the listed paths only. Entries ending in "/" match as prefixes.
+func WithOptionalPaths(paths ...string) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.optionalPaths = append(c.optionalPaths, paths...)
+	}
+}
+
+// WithRevocationCheck also checks that the token has not been revoked and the user is not disabled.
+// This costs a round-trip to Firebase on every request, or with WithTokenCache once per token every
+// RevocationCheckTTL, so a revocation made elsewhere can take that long to be seen.
+func WithRevocationCheck() MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.checkRevoked = true
+	}
+}
+
+// WithTenant rejects tokens whose firebase.tenant claim is not tenantID
+func WithTenant(tenantID string) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.tenantID = tenantID
+	}
+}
+
+// WithErrorHandler replaces the default 401 response
+func WithErrorHandler(h ErrorHandler) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.errorHandler = h
+	}
+}
+
+// NewContext returns a copy of ctx carrying the Principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// FromContext returns the Principal stored by the auth middleware
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey).(*Principal)
+	return p, ok && p != nil
+}
+
+// BearerToken returns the token from an "Authorization: Bearer" header, or "" if there is none
+func BearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return ""
+	}
+
+	return strings.TrimSpace(header[7:])
+}
+
+// Middleware returns net/http middleware that verifies the Firebase ID token on each request
+// and stores the resulting Principal in the request context
+func (f *FirebaseAuth) Middleware(opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	cfg := newMiddlewareConfig(opts)
+
+	extract := func(r *http.Request) string {
+		idToken := BearerToken(r)
+		if idToken == "" && cfg.cookieName != "" {
+			if cookie, err := r.Cookie(cfg.cookieName); err == nil {
+				idToken = cookie.Value
+			}
+		}
+		return idToken
+	}
+
+	verify := func(ctx context.Context, idToken string) (*auth.Token, error) {
+		return f.verifyIDToken(ctx, idToken, cfg.checkRevoked)
+	}
+
+	return verifyingMiddleware(cfg, extract, verify)
+}
+
+// verifyingMiddleware runs verify on the token returned by extract and stores the Principal in the request context
+func verifyingMiddleware(cfg *middlewareConfig, extract func(r *http.Request) string,
+	verify func(ctx context.Context, token string) (*auth.Token, error)) func(http.Handler) http.Handler {
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			value := extract(r)
+
+			if value == "" {
+				if cfg.isOptional(r) {
+					next.ServeHTTP(w, r)
+				} else {
+					cfg.errorHandler(w, r, ErrMissingToken)
+				}
+				return
+			}
+
+			token, err := verify(r.Context(), value)
+			if err != nil {
+				cfg.errorHandler(w, r, fmt.Errorf("%w: %w", ErrInvalidToken, err))
+				return
+			}
+
+			if cfg.tenantID != "" && token.Firebase.Tenant != cfg.tenantID {
+				cfg.errorHandler(w, r, ErrTenantMismatch)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), NewPrincipal(token))))
+		})
+	}
+}
+
+// newMiddlewareConfig
+func newMiddlewareConfig(opts []MiddlewareOption) *middlewareConfig {
+	cfg := &middlewareConfig{
+		errorHandler: defaultErrorHandler,
+	}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return cfg
+}
+
+// isOptional reports whether the request may proceed without a token
+func (c *middlewareConfig) isOptional(r *http.Request) bool {
+	if c.optional {
+		return true
+	}
+
+	for _, path := range c.optionalPaths {
+		if r.URL.Path == path || (strings.HasSuffix(path, "/") && strings.HasPrefix(r.URL.Path, path)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// defaultErrorHandler
+func defaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
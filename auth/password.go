@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrPasswordPolicy matches every *PasswordPolicyError
+var ErrPasswordPolicy = errors.New("password does not meet policy")
+
+// Password policy violation codes
+const (
+	ViolationTooShort      = "too_short"
+	ViolationTooLong       = "too_long"
+	ViolationMissingLower  = "missing_lower"
+	ViolationMissingUpper  = "missing_upper"
+	ViolationMissingDigit  = "missing_digit"
+	ViolationMissingSymbol = "missing_symbol"
+	ViolationBanned        = "banned"
+	ViolationContainsEmail = "contains_email"
+	ViolationBreached      = "breached"
+)
+
+// PasswordViolation is a single failed rule, safe to show to the user
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule the password failed
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	codes := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		codes[i] = v.Code
+	}
+
+	return fmt.Sprintf("%v: %v", ErrPasswordPolicy, strings.Join(codes, ", "))
+}
+
+// Is matches ErrPasswordPolicy
+func (e *PasswordPolicyError) Is(target error) bool {
+	return target == ErrPasswordPolicy
+}
+
+// BreachedPasswordChecker reports whether a password appears in a breach corpus
+type BreachedPasswordChecker interface {
+	IsBreached(ctx context.Context, password string) (bool, error)
+}
+
+// PasswordPolicy is checked before passwords are sent to Firebase. Zero fields disable their rule.
+type PasswordPolicy struct {
+	MinLength     int // in characters
+	MaxLength     int
+	RequireLower  bool
+	RequireUpper  bool
+	RequireDigit  bool
+	RequireSymbol bool // anything that is not a letter or digit
+
+	// Banned passwords are compared case-insensitively
+	Banned []string
+
+	// DisallowEmail rejects passwords containing the account email or its local part
+	DisallowEmail bool
+
+	// Breached optionally rejects passwords found in a breach corpus, e.g. a HIBPDirectory
+	Breached BreachedPasswordChecker
+
+	once   sync.Once
+	banned map[string]struct{}
+}
+
+// WithPasswordPolicy enforces policy in CreateUser, UpdateUser, UpdateUserFields (and so UpdateUserPassword),
+// SignUp, ChangePassword, ConfirmPasswordReset and LinkWithPassword
+func WithPasswordPolicy(policy *PasswordPolicy) Option {
+	return func(f *FirebaseAuth) {
+		f.passwordPolicy = policy
+	}
+}
+
+// Check returns a *PasswordPolicyError listing the violations, nil if the password is acceptable,
+// or the error of the breach checker. email may be empty.
+func (p *PasswordPolicy) Check(ctx context.Context, password string, email string) error {
+	var violations []PasswordViolation
+	add := func(code string, format string, args ...interface{}) {
+		violations = append(violations, PasswordViolation{Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if p.MinLength > 0 && length < p.MinLength {
+		add(ViolationTooShort, "password must be at least %d characters", p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		add(ViolationTooLong, "password must be at most %d characters", p.MaxLength)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsLetter(r):
+			symbol = true
+		}
+	}
+
+	if p.RequireLower && !lower {
+		add(ViolationMissingLower, "password must contain a lowercase letter")
+	}
+	if p.RequireUpper && !upper {
+		add(ViolationMissingUpper, "password must contain an uppercase letter")
+	}
+	if p.RequireDigit && !digit {
+		add(ViolationMissingDigit, "password must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		add(ViolationMissingSymbol, "password must contain a symbol")
+	}
+
+	if p.isBanned(password) {
+		add(ViolationBanned, "password is too common")
+	}
+
+	if p.DisallowEmail && containsEmail(password, email) {
+		add(ViolationContainsEmail, "password must not contain the email address")
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.IsBreached(ctx, password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			add(ViolationBreached, "password has appeared in a data breach")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+
+	return nil
+}
+
+// isBanned
+func (p *PasswordPolicy) isBanned(password string) bool {
+	p.once.Do(func() {
+		p.banned = make(map[string]struct{}, len(p.Banned))
+		for _, b := range p.Banned {
+			p.banned[strings.ToLower(b)] = struct{}{}
+		}
+	})
+
+	_, ok := p.banned[strings.ToLower(password)]
+	return ok
+}
+
+// containsEmail checks the full address and a local part of at least 3 characters
+func containsEmail(password string, email string) bool {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return false
+	}
+
+	password = strings.ToLower(password)
+	if strings.Contains(password, email) {
+		return true
+	}
+
+	local, _, _ := strings.Cut(email, "@")
+	return utf8.RuneCountInString(local) >= 3 && strings.Contains(password, local)
+}
+
+// HIBPDirectory checks passwords against a local copy of the Have I Been Pwned range files:
+// one file per 5 hex character SHA-1 prefix, named after the prefix with an optional .txt
+// extension, holding "SUFFIX:COUNT" lines
+type HIBPDirectory struct {
+	Dir      string
+	MinCount int // occurrences needed to count as breached, defaults to 1
+}
+
+// IsBreached
+func (h *HIBPDirectory) IsBreached(ctx context.Context, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(h.Dir, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		file, err = os.Open(filepath.Join(h.Dir, prefix+".txt"))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	minCount := h.MinCount
+	if minCount < 1 {
+		minCount = 1
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		s, c, _ := strings.Cut(line, ":")
+		if !strings.EqualFold(s, suffix) {
+			continue
+		}
+
+		count, err := strconv.Atoi(strings.TrimSpace(c))
+		if err != nil {
+			// a corpus without counts lists breached hashes only
+			count = 1
+		}
+
+		return count >= minCount, nil
+	}
+
+	return false, scanner.Err()
+}
+
+// checkPassword applies the configured policy, if any
+func (f *FirebaseAuth) checkPassword(ctx context.Context, password string, email string) error {
+	if f.passwordPolicy == nil {
+		return nil
+	}
+
+	return f.passwordPolicy.Check(ctx, password, email)
+}
+
+// idTokenEmail returns the email claim of idToken when the policy needs it. Verification errors
+// yield "", Firebase rejects the token itself.
+func (f *FirebaseAuth) idTokenEmail(ctx context.Context, idToken string) string {
+	if f.passwordPolicy == nil || !f.passwordPolicy.DisallowEmail {
+		return ""
+	}
+
+	token, err := f.verifyIDToken(ctx, idToken, false)
+	if err != nil {
+		return ""
+	}
+
+	email, _ := token.Claims["email"].(string)
+	return email
+}
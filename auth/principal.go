@@ -0,0 +1,263 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// Principal sources
+const (
+	SourceIDToken  = "id_token"
+	SourceEndpoint = "endpoint"
+	SourceGateway  = "gateway"
+	SourceCustom   = "custom"
+)
+
+// Principal is the authenticated caller, whichever way it was authenticated. The auth middlewares
+// store it in the request context.
+type Principal struct {
+	UID            string
+	Email          string
+	EmailVerified  bool
+	SignInProvider string // e.g. ProviderPassword, ProviderGoogle or "custom"
+	Tenant         string
+	Roles          []string
+	Permissions    []string
+	Claims         map[string]interface{}
+	AuthTime       time.Time // when the user last signed in, zero if unknown
+	Source         string    // one of the Source constants
+
+	// Token is the verified ID token, nil for other sources
+	Token *auth.Token
+}
+
+// NewPrincipal builds a Principal from a verified token
+func NewPrincipal(token *auth.Token) *Principal {
+	p := &Principal{
+		UID:            token.UID,
+		SignInProvider: token.Firebase.SignInProvider,
+		Tenant:         token.Firebase.Tenant,
+		Roles:          RolesFromClaims(token.Claims),
+		Permissions:    PermissionsFromClaims(token.Claims),
+		Claims:         token.Claims,
+		AuthTime:       unixTime(token.AuthTime),
+		Source:         SourceIDToken,
+		Token:          token,
+	}
+
+	if email, ok := token.Claims["email"].(string); ok {
+		p.Email = email
+	}
+	if verified, ok := token.Claims["email_verified"].(bool); ok {
+		p.EmailVerified = verified
+	}
+
+	return p
+}
+
+// PrincipalFromEndpointUser builds a Principal from the Cloud Endpoints user info
+func PrincipalFromEndpointUser(user *EndpointUser) *Principal {
+	p := &Principal{
+		UID:            user.UID,
+		Email:          user.Email,
+		SignInProvider: user.Firebase.SignInProvider,
+		Tenant:         user.Firebase.Tenant,
+		Roles:          RolesFromClaims(user.Claims),
+		Permissions:    PermissionsFromClaims(user.Claims),
+		Claims:         user.Claims,
+		Source:         SourceEndpoint,
+	}
+
+	if verified, ok := user.Claims["email_verified"].(bool); ok {
+		p.EmailVerified = verified
+	}
+	if authTime, ok := user.Claims["auth_time"].(float64); ok {
+		p.AuthTime = unixTime(int64(authTime))
+	}
+
+	return p
+}
+
+// PrincipalFromGatewayUser builds a Principal from the API Gateway user info
+func PrincipalFromGatewayUser(user *GatewayUser) *Principal {
+	uid := user.UserID
+	if uid == "" {
+		uid = user.Sub
+	}
+
+	return &Principal{
+		UID:            uid,
+		Email:          user.Email,
+		EmailVerified:  user.EmailVerified,
+		SignInProvider: user.Firebase.SignInProvider,
+		Tenant:         user.Firebase.Tenant,
+		Roles:          RolesFromClaims(user.Claims),
+		Permissions:    PermissionsFromClaims(user.Claims),
+		Claims:         user.Claims,
+		AuthTime:       unixTime(int64(user.AuthTime)),
+		Source:         SourceGateway,
+	}
+}
+
+// NewCustomPrincipal builds a Principal for uid holding the developer claims that would be put
+// into a custom token, e.g. for service accounts or jobs acting on a user's behalf
+func NewCustomPrincipal(uid string, claims map[string]interface{}) *Principal {
+	if claims == nil {
+		claims = map[string]interface{}{}
+	}
+
+	p := &Principal{
+		UID:            uid,
+		SignInProvider: SourceCustom,
+		Roles:          RolesFromClaims(claims),
+		Permissions:    PermissionsFromClaims(claims),
+		Claims:         claims,
+		Source:         SourceCustom,
+	}
+
+	if email, ok := claims["email"].(string); ok {
+		p.Email = email
+	}
+
+	return p
+}
+
+// VerifyPrincipal verifies idToken and returns its Principal, in place of GetRoleFromToken
+func (f *FirebaseAuth) VerifyPrincipal(ctx context.Context, idToken string) (*Principal, error) {
+	token, err := f.verifyIDToken(ctx, idToken, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPrincipal(token), nil
+}
+
+// unixTime returns the zero time for 0
+func unixTime(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(seconds, 0)
+}
+
+// WithGatewayUserInfo trusts the X-Apigateway-Api-Userinfo header in a Resolver. Only use it when
+// the service cannot be reached except through API Gateway.
+func WithGatewayUserInfo() MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.trustGateway = true
+	}
+}
+
+// WithEndpointUserInfo trusts the X-Endpoint-API-UserInfo header in a Resolver. Only use it when
+// the service cannot be reached except through ESP.
+func WithEndpointUserInfo() MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.trustEndpoint = true
+	}
+}
+
+// Resolver picks the Principal source for a request: an API key with WithAPIKeys, the trusted
+// gateway user info headers, then the bearer token (or cookie, with WithCookie) verified with
+// FirebaseAuth. The same handlers can then run behind API Gateway, Cloud Endpoints or directly.
+type Resolver struct {
+	fa  *FirebaseAuth
+	cfg *middlewareConfig
+}
+
+// NewResolver verifies tokens with f. f may be nil when only gateway headers are accepted.
+func NewResolver(f *FirebaseAuth, opts ...MiddlewareOption) *Resolver {
+	return &Resolver{
+		fa:  f,
+		cfg: newMiddlewareConfig(opts),
+	}
+}
+
+// Resolve returns the Principal for r, or ErrMissingToken when r carries no credentials
+func (res *Resolver) Resolve(r *http.Request) (*Principal, error) {
+	p, err := res.resolve(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.cfg.tenantID != "" && p.Tenant != res.cfg.tenantID {
+		return nil, ErrTenantMismatch
+	}
+
+	return p, nil
+}
+
+// resolve
+func (res *Resolver) resolve(r *http.Request) (*Principal, error) {
+	if res.cfg.apiKeys != nil {
+		if value := r.Header.Get(APIKeyHeader); value != "" {
+			return res.cfg.apiKeys.Authenticate(r.Context(), value)
+		}
+	}
+
+	if res.cfg.trustGateway {
+		if header := r.Header.Get(GatewayUserInfoHeader); header != "" {
+			user, err := DecodeGatewayUser(header)
+			if err != nil {
+				return nil, err
+			}
+			return PrincipalFromGatewayUser(user), nil
+		}
+	}
+
+	if res.cfg.trustEndpoint {
+		if header := r.Header.Get(EndpointUserInfoHeader); header != "" {
+			user, err := DecodeEndpointUser(header)
+			if err != nil {
+				return nil, err
+			}
+			return PrincipalFromEndpointUser(user), nil
+		}
+	}
+
+	idToken := BearerToken(r)
+	if idToken == "" && res.cfg.cookieName != "" {
+		if cookie, err := r.Cookie(res.cfg.cookieName); err == nil {
+			idToken = cookie.Value
+		}
+	}
+	if idToken == "" || res.fa == nil {
+		return nil, ErrMissingToken
+	}
+
+	token, err := res.fa.verifyIDToken(r.Context(), idToken, res.cfg.checkRevoked)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	return NewPrincipal(token), nil
+}
+
+// Middleware stores the resolved Principal in the request context
+func (res *Resolver) Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, err := res.Resolve(r)
+
+			if errors.Is(err, ErrMissingToken) && res.cfg.isOptional(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err != nil {
+				res.cfg.errorHandler(w, r, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), p)))
+		})
+	}
+}
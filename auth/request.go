@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ContextWithClientIP attaches the caller's IP address, which Login uses for per-IP lockouts
+func ContextWithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey, ip)
+}
+
+// ClientIPFromContext returns the IP set by ContextWithClientIP, or ""
+func ClientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
+
+// ContextWithUserAgent attaches the caller's user agent, recorded in audit events
+func ContextWithUserAgent(ctx context.Context, userAgent string) context.Context {
+	return context.WithValue(ctx, userAgentKey, userAgent)
+}
+
+// UserAgentFromContext returns the user agent set by ContextWithUserAgent, or ""
+func UserAgentFromContext(ctx context.Context) string {
+	ua, _ := ctx.Value(userAgentKey).(string)
+	return ua
+}
+
+// ContextWithActor attaches the UID of whoever performs the operation, recorded in audit events,
+// e.g. an administrator acting on another account or a job's service identity
+func ContextWithActor(ctx context.Context, uid string) context.Context {
+	return context.WithValue(ctx, actorKey, uid)
+}
+
+// ActorFromContext returns the actor set by ContextWithActor, else the UID of the Principal in ctx, or ""
+func ActorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey).(string); ok && actor != "" {
+		return actor
+	}
+
+	if p, ok := FromContext(ctx); ok {
+		return p.UID
+	}
+
+	return ""
+}
+
+// ClientInfo stores the caller's IP address and user agent in the request context, for the
+// per-IP lockouts of Login and for audit events. trustedHops is passed to ClientIP.
+func ClientInfo(trustedHops int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := ContextWithClientIP(r.Context(), ClientIP(r, trustedHops))
+			ctx = ContextWithUserAgent(ctx, r.UserAgent())
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// ClientIP returns the caller's IP address. trustedHops is the number of X-Forwarded-For entries
+// appended by your own infrastructure, counted from the right (e.g. 1 behind Cloud Run, 2 behind an
+// external HTTP(S) load balancer). Entries further left are client supplied and ignored. With
+// trustedHops 0, or too few entries, RemoteAddr is used.
+func ClientIP(r *http.Request, trustedHops int) string {
+	if trustedHops > 0 {
+		if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			hops := strings.Split(strings.Join(xff, ","), ",")
+			if len(hops) >= trustedHops {
+				if ip := strings.TrimSpace(hops[len(hops)-trustedHops]); ip != "" {
+					return ip
+				}
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
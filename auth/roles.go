@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"net/http"
+	"sort"
+)
+
+// Custom claim keys used for role based access control
+const (
+	RoleClaim        = "role" // single role, kept for tokens minted before multi-role support
+	RolesClaim       = "roles"
+	PermissionsClaim = "permissions"
+)
+
+// RolesFromClaims returns the roles held in the "roles" claim and the legacy "role" claim
+func RolesFromClaims(claims map[string]interface{}) []string {
+	roles := stringsFromClaim(claims[RolesClaim])
+
+	if role, ok := claims[RoleClaim].(string); ok && role != "" && !contains(roles, role) {
+		roles = append(roles, role)
+	}
+
+	return roles
+}
+
+// PermissionsFromClaims returns the permissions held in the "permissions" claim
+func PermissionsFromClaims(claims map[string]interface{}) []string {
+	return stringsFromClaim(claims[PermissionsClaim])
+}
+
+// HasRole reports whether the principal holds at least one of roles
+func (p *Principal) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if contains(p.Roles, role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasPermission reports whether the principal holds at least one of perms
+func (p *Principal) HasPermission(perms ...string) bool {
+	for _, perm := range perms {
+		if contains(p.Permissions, perm) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetRoles returns the roles currently stored in the user's custom claims
+func (f *FirebaseAuth) GetRoles(ctx context.Context, uid string) ([]string, error) {
+	user, err := f.client.GetUser(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	return RolesFromClaims(user.CustomClaims), nil
+}
+
+// MergeCustomClaims applies updates on top of the user's existing custom claims.
+// A nil value removes the key. Other keys are left untouched.
+//
+// The read-modify-write is not atomic, so concurrent updates to the same user can overwrite each other.
+func (f *FirebaseAuth) MergeCustomClaims(ctx context.Context, uid string, updates map[string]interface{}) error {
+	user, err := f.client.GetUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	claims := make(map[string]interface{}, len(user.CustomClaims)+len(updates))
+	for k, v := range user.CustomClaims {
+		claims[k] = v
+	}
+
+	for k, v := range updates {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+
+	err = f.client.SetCustomUserClaims(ctx, uid, claims)
+
+	keys := make([]string, 0, len(updates))
+	for k := range updates {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	f.audit(ctx, &AuditEvent{Type: AuditClaimsChanged, UID: uid, Details: map[string]interface{}{"claims": keys}}, err)
+
+	return err
+}
+
+// SetRoles replaces the user's roles. The legacy "role" claim is folded into "roles".
+// The new roles show up in ID tokens after the next refresh; use RevokeRefreshTokens to force it.
+func (f *FirebaseAuth) SetRoles(ctx context.Context, uid string, roles ...string) error {
+	return f.MergeCustomClaims(ctx, uid, map[string]interface{}{
+		RolesClaim: dedupe(roles),
+		RoleClaim:  nil,
+	})
+}
+
+// AddRole adds role to the user's existing roles
+func (f *FirebaseAuth) AddRole(ctx context.Context, uid string, role string) error {
+	roles, err := f.GetRoles(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	if contains(roles, role) {
+		return nil
+	}
+
+	return f.SetRoles(ctx, uid, append(roles, role)...)
+}
+
+// RemoveRole removes role from the user's existing roles
+func (f *FirebaseAuth) RemoveRole(ctx context.Context, uid string, role string) error {
+	roles, err := f.GetRoles(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	kept := make([]string, 0, len(roles))
+	for _, r := range roles {
+		if r != role {
+			kept = append(kept, r)
+		}
+	}
+
+	return f.SetRoles(ctx, uid, kept...)
+}
+
+// SetPermissions replaces the user's permission list
+func (f *FirebaseAuth) SetPermissions(ctx context.Context, uid string, perms ...string) error {
+	return f.MergeCustomClaims(ctx, uid, map[string]interface{}{
+		PermissionsClaim: dedupe(perms),
+	})
+}
+
+// RevokeRefreshTokens invalidates the user's refresh tokens so they have to sign in again,
+// which is what makes changed custom claims take effect straight away
+func (f *FirebaseAuth) RevokeRefreshTokens(uid string) error {
+	return f.RevokeRefreshTokensContext(context.Background(), uid)
+}
+
+// RevokeRefreshTokensContext
+func (f *FirebaseAuth) RevokeRefreshTokensContext(ctx context.Context, uid string) error {
+	err := f.client.RevokeRefreshTokens(ctx, uid)
+	f.audit(ctx, &AuditEvent{Type: AuditTokensRevoked, UID: uid}, err)
+
+	if err != nil {
+		return err
+	}
+
+	f.invalidateCachedTokens(uid)
+
+	return nil
+}
+
+// RequireRole rejects requests whose Principal holds none of roles. It must run after the auth middleware.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return requirePrincipal(func(p *Principal) bool {
+		return p.HasRole(roles...)
+	})
+}
+
+// RequireAnyPermission rejects requests whose Principal holds none of perms. It must run after the auth middleware.
+func RequireAnyPermission(perms ...string) func(http.Handler) http.Handler {
+	return requirePrincipal(func(p *Principal) bool {
+		return p.HasPermission(perms...)
+	})
+}
+
+// requirePrincipal responds 401 without a Principal and 403 when allowed returns false
+func requirePrincipal(allowed func(p *Principal) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := FromContext(r.Context())
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			if !allowed(p) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// stringsFromClaim accepts either a string list or a single string
+func stringsFromClaim(v interface{}) []string {
+	switch val := v.(type) {
+	case string:
+		if val != "" {
+			return []string{val}
+		}
+	case []string:
+		return dedupe(val)
+	case []interface{}:
+		out := make([]string, 0, len(val))
+		for _, item := range val {
+			if s, ok := item.(string); ok && s != "" {
+				out = append(out, s)
+			}
+		}
+		return dedupe(out)
+	}
+
+	return nil
+}
+
+// dedupe removes duplicates while keeping order
+func dedupe(values []string) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if !contains(out, v) {
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
+
+// contains
+func contains(values []string, v string) bool {
+	for _, item := range values {
+		if item == v {
+			return true
+		}
+	}
+
+	return false
+}
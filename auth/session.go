@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// Session cookie lifetimes allowed by Firebase
+const (
+	MinSessionDuration = 5 * time.Minute
+	MaxSessionDuration = 14 * 24 * time.Hour
+)
+
+// Defaults for the CSRF double-submit cookie
+const (
+	CSRFCookieName = "csrf_token"
+	CSRFHeaderName = "X-CSRF-Token"
+	CSRFFormField  = "csrf_token"
+)
+
+// CreateSessionCookie exchanges an ID token for a session cookie valid for expiresIn.
+// Only do this for a recent sign-in, since the cookie outlives the ID token.
+func (f *FirebaseAuth) CreateSessionCookie(ctx context.Context, idToken string, expiresIn time.Duration) (string, error) {
+	if expiresIn < MinSessionDuration || expiresIn > MaxSessionDuration {
+		return "", fmt.Errorf("session duration must be between %v and %v", MinSessionDuration, MaxSessionDuration)
+	}
+
+	if f.tenantID != "" {
+		return "", ErrTenantUnsupported
+	}
+
+	return f.project.SessionCookie(ctx, idToken, expiresIn)
+}
+
+// VerifySessionCookie verifies a session cookie, optionally checking that it has not been revoked
+func (f *FirebaseAuth) VerifySessionCookie(ctx context.Context, cookie string, checkRevoked bool) (*auth.Token, error) {
+	if f.tenantID != "" {
+		return nil, ErrTenantUnsupported
+	}
+
+	if checkRevoked {
+		token, err := f.project.VerifySessionCookieAndCheckRevoked(ctx, cookie)
+		if err != nil {
+			return nil, revocationError(err)
+		}
+		return token, nil
+	}
+
+	return f.project.VerifySessionCookie(ctx, cookie)
+}
+
+// SetSessionCookie writes the session cookie as an HttpOnly, Secure, SameSite=Lax cookie
+func SetSessionCookie(w http.ResponseWriter, name string, value string, expiresIn time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(expiresIn.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearSessionCookie expires the session cookie in the browser. It does not revoke the session,
+// use RevokeRefreshTokens for that.
+func ClearSessionCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// SessionMiddleware verifies the session cookie called cookieName and stores the Principal
+// in the request context, like Middleware does for ID tokens
+func (f *FirebaseAuth) SessionMiddleware(cookieName string, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	cfg := newMiddlewareConfig(opts)
+
+	extract := func(r *http.Request) string {
+		if cookie, err := r.Cookie(cookieName); err == nil {
+			return cookie.Value
+		}
+		return ""
+	}
+
+	verify := func(ctx context.Context, cookie string) (*auth.Token, error) {
+		return f.VerifySessionCookie(ctx, cookie, cfg.checkRevoked)
+	}
+
+	return verifyingMiddleware(cfg, extract, verify)
+}
+
+// NewCSRFToken returns a random token for the CSRF double-submit cookie
+func NewCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// SetCSRFCookie writes the CSRF cookie. It is readable from JavaScript so the page can echo it back.
+func SetCSRFCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    token,
+		Path:     "/",
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// CSRFProtect rejects unsafe requests (anything but GET, HEAD, OPTIONS and TRACE) unless the CSRF cookie
+// matches the X-CSRF-Token header or the csrf_token form field. Put it in front of the session login endpoint.
+func CSRFProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(CSRFCookieName)
+		if err != nil || cookie.Value == "" {
+			http.Error(w, "missing csrf token", http.StatusForbidden)
+			return
+		}
+
+		submitted := r.Header.Get(CSRFHeaderName)
+		if submitted == "" {
+			submitted = r.PostFormValue(CSRFFormField)
+		}
+
+		if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(submitted)) != 1 {
+			http.Error(w, "invalid csrf token", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
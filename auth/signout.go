@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// ErrTokenRevoked is returned for ID tokens and session cookies issued before the user's refresh tokens were revoked
+var ErrTokenRevoked = errors.New("token revoked")
+
+// reenableTimeout bounds the call that re-enables an account after SignOutEverywhere
+const reenableTimeout = 30 * time.Second
+
+// VerifyTokenAndCheckRevoked verifies idToken and also rejects it if the user's tokens were revoked
+// or the account is disabled. It costs a user lookup per call unless a TokenCache is configured.
+func (f *FirebaseAuth) VerifyTokenAndCheckRevoked(idToken string) (*auth.Token, error) {
+	return f.VerifyTokenAndCheckRevokedContext(context.Background(), idToken)
+}
+
+// VerifyTokenAndCheckRevokedContext
+func (f *FirebaseAuth) VerifyTokenAndCheckRevokedContext(ctx context.Context, idToken string) (*auth.Token, error) {
+	return f.verifyIDToken(ctx, idToken, true)
+}
+
+// revocationError maps the Admin SDK revocation errors of ID tokens and session cookies to the sentinel errors
+func revocationError(err error) error {
+	switch {
+	case auth.IsIDTokenRevoked(err), auth.IsSessionCookieRevoked(err):
+		return fmt.Errorf("%w: %w", ErrTokenRevoked, err)
+	case auth.IsUserDisabled(err):
+		return fmt.Errorf("%w: %w", ErrUserDisabled, err)
+	}
+
+	return err
+}
+
+// SignOutEverywhere revokes the user's refresh tokens and disables the account for grace, so ID tokens
+// already issued stop working at once for anything checking revocation and the user cannot sign straight
+// back in. The account is re-enabled by a timer in this process, which the returned *time.Timer can stop;
+// it is nil when grace is 0 and the account is left enabled. An account that is already disabled, e.g. by
+// an administrator after a compromise, is left disabled and no timer is started.
+//
+// The timer only lives in this process: if the process exits before it fires, the account stays disabled
+// until re-enabled with UpdateUserDisabled. Stop the timer when disabling the account for good during grace.
+func (f *FirebaseAuth) SignOutEverywhere(ctx context.Context, uid string, grace time.Duration) (*time.Timer, error) {
+	event := &AuditEvent{
+		Type:    AuditSignedOut,
+		UID:     uid,
+		Details: map[string]interface{}{"grace": grace.String()},
+	}
+
+	if err := f.client.RevokeRefreshTokens(ctx, uid); err != nil {
+		f.audit(ctx, event, err)
+		return nil, err
+	}
+	f.invalidateCachedTokens(uid)
+
+	if grace <= 0 {
+		f.audit(ctx, event, nil)
+		return nil, nil
+	}
+
+	user, err := f.client.GetUser(ctx, uid)
+	if err != nil {
+		f.audit(ctx, event, err)
+		return nil, err
+	}
+	if user.Disabled {
+		event.Details["already_disabled"] = true
+		f.audit(ctx, event, nil)
+		return nil, nil
+	}
+
+	if _, err := f.UpdateUserFields(ctx, uid, &UserUpdate{Disabled: Bool(true)}); err != nil {
+		f.audit(ctx, event, err)
+		return nil, err
+	}
+	f.audit(ctx, event, nil)
+
+	timer := time.AfterFunc(grace, func() {
+		reCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), reenableTimeout)
+		defer cancel()
+
+		_, err := f.UpdateUserFields(reCtx, uid, &UserUpdate{Disabled: Bool(false)})
+		f.audit(reCtx, &AuditEvent{Type: AuditAccountReenabled, UID: uid}, err)
+	})
+
+	return timer, nil
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vrus/gcp-golib/storage"
+)
+
+// Store is the subset of storage.MemStore used for counters and small records,
+// so the same code runs against Redis in production and LocalStore in tests
+type Store interface {
+	IncrementAndExpire(key string, maxValue int, expiry float64) (int, bool)
+	GetKey(key string, dest interface{}) error
+	SaveKey(key string, val interface{}, expiry int) bool
+	DeleteKey(key string) bool
+}
+
+var _ Store = (*storage.MemStore)(nil)
+
+// LocalStore is an in-process Store with the same semantics as storage.MemStore
+type LocalStore struct {
+	mu   sync.Mutex
+	keys map[string]localEntry
+}
+
+type localEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// NewLocalStore
+func NewLocalStore() *LocalStore {
+	return &LocalStore{
+		keys: make(map[string]localEntry),
+	}
+}
+
+// IncrementAndExpire will attempt to increment a key if it doesnt exceed maxValue. expiry is in seconds.
+func (l *LocalStore) IncrementAndExpire(key string, maxValue int, expiry float64) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var value int
+	if entry, ok := l.get(key); ok {
+		if err := json.Unmarshal(entry.data, &value); err != nil {
+			return 0, false
+		}
+	}
+
+	if maxValue > 0 && value >= maxValue {
+		return value, false
+	}
+
+	value++
+	data, _ := json.Marshal(value)
+	l.keys[key] = localEntry{
+		data:    data,
+		expires: time.Now().Add(time.Duration(expiry * float64(time.Second))),
+	}
+
+	return value, true
+}
+
+// GetKey decodes the value of key into dest. A missing key leaves dest untouched.
+func (l *LocalStore) GetKey(key string, dest interface{}) error {
+	l.mu.Lock()
+	entry, ok := l.get(key)
+	l.mu.Unlock()
+
+	if !ok || len(entry.data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(entry.data, dest)
+}
+
+// SaveKey: if you pass in expiry > 0 it will expire the key. expiry is in seconds
+func (l *LocalStore) SaveKey(key string, val interface{}, expiry int) bool {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return false
+	}
+
+	entry := localEntry{data: data}
+	if expiry > 0 {
+		entry.expires = time.Now().Add(time.Duration(expiry) * time.Second)
+	}
+
+	l.mu.Lock()
+	l.keys[key] = entry
+	l.mu.Unlock()
+
+	return true
+}
+
+// DeleteKey removes a key from LocalStore
+func (l *LocalStore) DeleteKey(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.get(key)
+	delete(l.keys, key)
+
+	return ok
+}
+
+// ScanKeys returns the keys matching a glob pattern like storage.MemStore.ScanKeys, except that
+// path.Match is used, so * does not match "/"
+func (l *LocalStore) ScanKeys(pattern string) ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var keys []string
+	for key := range l.keys {
+		matched, err := path.Match(pattern, key)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := l.get(key); ok && matched {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// get returns an unexpired entry. Callers must hold the lock.
+func (l *LocalStore) get(key string) (localEntry, bool) {
+	entry, ok := l.keys[key]
+	if !ok {
+		return entry, false
+	}
+
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		delete(l.keys, key)
+		return entry, false
+	}
+
+	return entry, true
+}
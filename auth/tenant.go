@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"errors"
+
+	"firebase.google.com/go/v4/auth"
+	"google.golang.org/api/iterator"
+)
+
+var (
+	ErrTenantMismatch    = errors.New("token belongs to a different tenant")
+	ErrTenantUnsupported = errors.New("operation is not supported for tenants")
+)
+
+// userClient is the part of the Admin SDK shared by auth.Client and auth.TenantClient
+type userClient interface {
+	VerifyIDToken(ctx context.Context, idToken string) (*auth.Token, error)
+	VerifyIDTokenAndCheckRevoked(ctx context.Context, idToken string) (*auth.Token, error)
+	CustomToken(ctx context.Context, uid string) (string, error)
+	CustomTokenWithClaims(ctx context.Context, uid string, devClaims map[string]interface{}) (string, error)
+	CreateUser(ctx context.Context, user *auth.UserToCreate) (*auth.UserRecord, error)
+	UpdateUser(ctx context.Context, uid string, user *auth.UserToUpdate) (*auth.UserRecord, error)
+	GetUser(ctx context.Context, uid string) (*auth.UserRecord, error)
+	GetUserByEmail(ctx context.Context, email string) (*auth.UserRecord, error)
+	SetCustomUserClaims(ctx context.Context, uid string, customClaims map[string]interface{}) error
+	RevokeRefreshTokens(ctx context.Context, uid string) error
+	PasswordResetLink(ctx context.Context, email string) (string, error)
+	EmailSignInLink(ctx context.Context, email string, settings *auth.ActionCodeSettings) (string, error)
+	Users(ctx context.Context, nextPageToken string) *auth.UserIterator
+	ImportUsers(ctx context.Context, users []*auth.UserToImport, opts ...auth.UserImportOption) (*auth.UserImportResult, error)
+	DeleteUser(ctx context.Context, uid string) error
+	DeleteUsers(ctx context.Context, uids []string) (*auth.DeleteUsersResult, error)
+}
+
+// ForTenant returns a copy of f that runs every operation against the Identity Platform tenant.
+// REST calls send the tenantId, and VerifyToken rejects tokens issued for other tenants.
+// Session cookies are not available for tenants.
+func (f *FirebaseAuth) ForTenant(tenantID string) (*FirebaseAuth, error) {
+	tc, err := f.project.TenantManager.AuthForTenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	scoped := *f
+	scoped.client = tc
+	scoped.tenantID = tenantID
+
+	return &scoped, nil
+}
+
+// TenantID returns the tenant f is scoped to, or "" at project level
+func (f *FirebaseAuth) TenantID() string {
+	return f.tenantID
+}
+
+// GetTenant
+func (f *FirebaseAuth) GetTenant(ctx context.Context, tenantID string) (*auth.Tenant, error) {
+	return f.project.TenantManager.Tenant(ctx, tenantID)
+}
+
+// CreateTenant
+func (f *FirebaseAuth) CreateTenant(ctx context.Context, tenant *auth.TenantToCreate) (*auth.Tenant, error) {
+	return f.project.TenantManager.CreateTenant(ctx, tenant)
+}
+
+// UpdateTenant
+func (f *FirebaseAuth) UpdateTenant(ctx context.Context, tenantID string, tenant *auth.TenantToUpdate) (*auth.Tenant, error) {
+	return f.project.TenantManager.UpdateTenant(ctx, tenantID, tenant)
+}
+
+// DeleteTenant
+func (f *FirebaseAuth) DeleteTenant(ctx context.Context, tenantID string) error {
+	return f.project.TenantManager.DeleteTenant(ctx, tenantID)
+}
+
+// ListTenants returns every tenant in the project
+func (f *FirebaseAuth) ListTenants(ctx context.Context) ([]*auth.Tenant, error) {
+	var tenants []*auth.Tenant
+
+	it := f.project.TenantManager.Tenants(ctx, "")
+	for {
+		tenant, err := it.Next()
+		if err == iterator.Done {
+			return tenants, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		tenants = append(tenants, tenant)
+	}
+}
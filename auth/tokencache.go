@@ -0,0 +1,276 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// DefaultTokenCacheSize is the number of entries used when NewTokenCache is given a size <= 0
+const DefaultTokenCacheSize = 10000
+
+// RevocationCheckTTL is how long a revocation check is reused. A revocation made by another instance
+// or in the console is seen by lookups with a revocation check at most this late.
+const RevocationCheckTTL = time.Minute
+
+// TokenCache is a bounded LRU of verified ID tokens, keyed by the SHA-256 of the token so raw tokens
+// are never held in memory. Entries expire at the token's exp or after the TTL, whichever is sooner,
+// and are dropped when the user's tokens are revoked, the user is disabled or deleted through FirebaseAuth.
+// Lookups that ask for a revocation check only reuse one made within RevocationCheckTTL.
+// Tokens returned from the cache are shared and must be treated as read-only.
+type TokenCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[[sha256.Size]byte]*list.Element
+	byUID map[string]map[[sha256.Size]byte]struct{}
+	now   func() time.Time
+
+	hits          uint64
+	misses        uint64
+	evictions     uint64
+	invalidations uint64
+}
+
+type tokenCacheEntry struct {
+	key     [sha256.Size]byte
+	token   *auth.Token
+	expires time.Time
+	checked time.Time // last verified with a revocation check, zero if never
+}
+
+// TokenCacheStats is a snapshot of the cache counters
+type TokenCacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64 // entries dropped to make room, not expiries
+	Invalidations uint64 // entries dropped by InvalidateUser
+	Size          int
+	Capacity      int
+}
+
+// HitRatio returns hits / lookups, or 0 before the first lookup
+func (s TokenCacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// NewTokenCache holds up to size entries. A ttl of 0 keeps entries until the token expires.
+func NewTokenCache(size int, ttl time.Duration) *TokenCache {
+	if size <= 0 {
+		size = DefaultTokenCacheSize
+	}
+
+	return &TokenCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[[sha256.Size]byte]*list.Element),
+		byUID: make(map[string]map[[sha256.Size]byte]struct{}),
+		now:   time.Now,
+	}
+}
+
+// WithTokenCache caches the results of VerifyToken and the middleware's token verification
+func WithTokenCache(c *TokenCache) Option {
+	return func(f *FirebaseAuth) {
+		f.cache = c
+	}
+}
+
+// SetClock replaces time.Now, for tests
+func (c *TokenCache) SetClock(now func() time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = now
+}
+
+// Get returns the cached token. When checked is true only entries verified with a revocation check
+// within RevocationCheckTTL match.
+func (c *TokenCache) Get(scope string, idToken string, checked bool) (*auth.Token, bool) {
+	key := tokenCacheKey(scope, idToken)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	entry := el.Value.(*tokenCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(el)
+		c.misses++
+		return nil, false
+	}
+	if checked && !c.now().Before(entry.checked.Add(RevocationCheckTTL)) {
+		c.misses++
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	c.hits++
+
+	return entry.token, true
+}
+
+// Put stores a verified token, evicting the least recently used entry when full
+func (c *TokenCache) Put(scope string, idToken string, token *auth.Token, checked bool) {
+	key := tokenCacheKey(scope, idToken)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Unix(token.Expires, 0)
+	if c.ttl > 0 {
+		if limit := c.now().Add(c.ttl); limit.Before(expires) {
+			expires = limit
+		}
+	}
+	if !c.now().Before(expires) {
+		return
+	}
+
+	var checkedAt time.Time
+	if checked {
+		checkedAt = c.now()
+	}
+
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*tokenCacheEntry)
+		entry.token = token
+		entry.expires = expires
+		if checked {
+			entry.checked = checkedAt
+		}
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	for c.ll.Len() >= c.size {
+		c.remove(c.ll.Back())
+		c.evictions++
+	}
+
+	c.items[key] = c.ll.PushFront(&tokenCacheEntry{key: key, token: token, expires: expires, checked: checkedAt})
+
+	keys, ok := c.byUID[token.UID]
+	if !ok {
+		keys = make(map[[sha256.Size]byte]struct{})
+		c.byUID[token.UID] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// InvalidateUser drops every cached token of uid
+func (c *TokenCache) InvalidateUser(uid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.byUID[uid] {
+		if el, ok := c.items[key]; ok {
+			c.remove(el)
+			c.invalidations++
+		}
+	}
+}
+
+// Purge drops all entries. The counters are kept.
+func (c *TokenCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[[sha256.Size]byte]*list.Element)
+	c.byUID = make(map[string]map[[sha256.Size]byte]struct{})
+}
+
+// Stats
+func (c *TokenCache) Stats() TokenCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return TokenCacheStats{
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Evictions:     c.evictions,
+		Invalidations: c.invalidations,
+		Size:          c.ll.Len(),
+		Capacity:      c.size,
+	}
+}
+
+// remove unlinks el from the list and both indexes. The caller holds mu.
+func (c *TokenCache) remove(el *list.Element) {
+	entry := c.ll.Remove(el).(*tokenCacheEntry)
+	delete(c.items, entry.key)
+
+	uid := entry.token.UID
+	if keys, ok := c.byUID[uid]; ok {
+		delete(keys, entry.key)
+		if len(keys) == 0 {
+			delete(c.byUID, uid)
+		}
+	}
+}
+
+// tokenCacheKey includes the tenant so a token verified by one scope is never served to another
+func tokenCacheKey(scope string, idToken string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(scope + "\x00" + idToken))
+}
+
+// verifyIDToken verifies idToken through the cache, if configured
+func (f *FirebaseAuth) verifyIDToken(ctx context.Context, idToken string, checkRevoked bool) (*auth.Token, error) {
+	if f.cache != nil {
+		if token, ok := f.cache.Get(f.tenantID, idToken, checkRevoked); ok {
+			return token, nil
+		}
+	}
+
+	var token *auth.Token
+	var err error
+
+	if checkRevoked {
+		if token, err = f.client.VerifyIDTokenAndCheckRevoked(ctx, idToken); err != nil {
+			err = revocationError(err)
+		}
+	} else {
+		token, err = f.tokenVerifier().VerifyIDToken(ctx, idToken)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// a tenant scoped Admin SDK client checks this itself, a LocalVerifier does not know the tenant
+	if f.tenantID != "" && token.Firebase.Tenant != f.tenantID {
+		return nil, ErrTenantMismatch
+	}
+
+	if f.cache != nil {
+		f.cache.Put(f.tenantID, idToken, token, checkRevoked)
+	}
+
+	return token, nil
+}
+
+// invalidateCachedTokens
+func (f *FirebaseAuth) invalidateCachedTokens(uid string) {
+	if f.cache != nil {
+		f.cache.InvalidateUser(uid)
+	}
+}
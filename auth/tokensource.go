@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRefreshLeeway is how long before expiry a TokenSource refreshes the ID token
+	DefaultRefreshLeeway = 5 * time.Minute
+
+	refreshTimeout = 30 * time.Second
+)
+
+// TokenSource keeps a Firebase ID token fresh using the refresh token. It is safe for concurrent use,
+// and concurrent callers that find the token expiring share a single refresh call.
+type TokenSource struct {
+	fa     *FirebaseAuth
+	leeway time.Duration
+
+	mu           sync.Mutex
+	idToken      string
+	refreshToken string
+	expiry       time.Time
+	inflight     *refreshCall
+}
+
+type refreshCall struct {
+	done    chan struct{}
+	idToken string
+	err     error
+}
+
+// NewTokenSource seeds a TokenSource from a Login response
+func (f *FirebaseAuth) NewTokenSource(resp *FBLoginResp) *TokenSource {
+	return &TokenSource{
+		fa:           f,
+		leeway:       DefaultRefreshLeeway,
+		idToken:      resp.IDToken,
+		refreshToken: resp.RefreshToken,
+		expiry:       expiryFromNow(resp.ExpiresIn),
+	}
+}
+
+// NewTokenSourceFromRefreshToken creates a TokenSource that fetches its first ID token on demand
+func (f *FirebaseAuth) NewTokenSourceFromRefreshToken(refreshToken string) *TokenSource {
+	return &TokenSource{
+		fa:           f,
+		leeway:       DefaultRefreshLeeway,
+		refreshToken: refreshToken,
+	}
+}
+
+// SetLeeway changes how long before expiry the token is refreshed
+func (ts *TokenSource) SetLeeway(leeway time.Duration) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.leeway = leeway
+}
+
+// Token returns a valid ID token, refreshing it first if it expires within the leeway.
+// Refresh failures are returned as the errors from RefreshToken (e.g. ErrInvalidRefreshToken).
+func (ts *TokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+
+	if ts.idToken != "" && time.Now().Add(ts.leeway).Before(ts.expiry) {
+		idToken := ts.idToken
+		ts.mu.Unlock()
+		return idToken, nil
+	}
+
+	call := ts.inflight
+	if call == nil {
+		call = &refreshCall{done: make(chan struct{})}
+		ts.inflight = call
+
+		// the refresh is shared, so it must not be cancelled by the caller that happened to start it
+		go ts.refresh(context.WithoutCancel(ctx), call, ts.refreshToken)
+	}
+
+	ts.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.idToken, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// RefreshToken returns the current refresh token, e.g. to persist it between runs
+func (ts *TokenSource) RefreshToken() string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.refreshToken
+}
+
+// Invalidate forces the next Token call to refresh, e.g. after a 401 caused by revoked claims
+func (ts *TokenSource) Invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.expiry = time.Time{}
+}
+
+// Client returns an http.Client that sends the ID token as a bearer token
+func (ts *TokenSource) Client() *http.Client {
+	return &http.Client{
+		Transport: &Transport{Source: ts},
+	}
+}
+
+// refresh
+func (ts *TokenSource) refresh(ctx context.Context, call *refreshCall, refreshToken string) {
+	ctx, cancel := context.WithTimeout(ctx, refreshTimeout)
+	defer cancel()
+
+	resp, err := ts.fa.RefreshTokenContext(ctx, refreshToken)
+
+	ts.mu.Lock()
+	if err != nil {
+		call.err = err
+	} else {
+		ts.idToken = resp.IDToken
+		ts.refreshToken = resp.RefreshToken
+		ts.expiry = expiryFromNow(resp.ExpiresIn)
+		call.idToken = resp.IDToken
+	}
+	ts.inflight = nil
+	ts.mu.Unlock()
+
+	close(call.done)
+}
+
+// Transport is an http.RoundTripper that adds the TokenSource's ID token as a bearer token
+type Transport struct {
+	Source *TokenSource
+	Base   http.RoundTripper // http.DefaultTransport when nil
+}
+
+// RoundTrip
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	idToken, err := t.Source.Token(r.Context())
+	if err != nil {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, err
+	}
+
+	// RoundTrippers must not modify the original request
+	req := r.Clone(r.Context())
+	req.Header.Set("Authorization", "Bearer "+idToken)
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return base.RoundTrip(req)
+}
+
+// expiryFromNow converts the expiresIn seconds string returned by Firebase to a time
+func expiryFromNow(expiresIn string) time.Time {
+	seconds, err := strconv.Atoi(expiresIn)
+	if err != nil || seconds <= 0 {
+		seconds = 3600
+	}
+
+	return time.Now().Add(time.Duration(seconds) * time.Second)
+}
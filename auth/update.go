@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// UserUpdate lists the fields UpdateUserFields changes. Nil fields are left untouched.
+// Pointing DisplayName, PhotoURL or PhoneNumber at "" removes the value from the account.
+type UserUpdate struct {
+	Email         *string
+	Password      *string
+	DisplayName   *string
+	PhotoURL      *string
+	PhoneNumber   *string
+	EmailVerified *bool
+	Disabled      *bool
+
+	// CustomClaims replaces all custom claims when non-nil; an empty map clears them.
+	// Use MergeCustomClaims to keep the existing keys.
+	CustomClaims map[string]interface{}
+
+	// ProviderToLink links a federated identity, e.g. a Google account, to the user
+	ProviderToLink *auth.UserProvider
+	// ProvidersToDelete unlinks providers by ID, e.g. "google.com" or "phone"
+	ProvidersToDelete []string
+}
+
+// String returns a pointer to s, for filling UserUpdate
+func String(s string) *string {
+	return &s
+}
+
+// Bool returns a pointer to b, for filling UserUpdate
+func Bool(b bool) *bool {
+	return &b
+}
+
+// UpdateUserFields applies the non-nil fields of update and returns the updated user record
+func (f *FirebaseAuth) UpdateUserFields(ctx context.Context, uid string, update *UserUpdate) (*auth.UserRecord, error) {
+	if update.Password != nil {
+		if err := f.checkUpdatePassword(ctx, uid, update); err != nil {
+			return nil, err
+		}
+	}
+
+	params := &auth.UserToUpdate{}
+
+	if update.Email != nil {
+		params = params.Email(*update.Email)
+	}
+	if update.Password != nil {
+		params = params.Password(*update.Password)
+	}
+	if update.DisplayName != nil {
+		params = params.DisplayName(*update.DisplayName)
+	}
+	if update.PhotoURL != nil {
+		params = params.PhotoURL(*update.PhotoURL)
+	}
+	if update.PhoneNumber != nil {
+		params = params.PhoneNumber(*update.PhoneNumber)
+	}
+	if update.EmailVerified != nil {
+		params = params.EmailVerified(*update.EmailVerified)
+	}
+	if update.Disabled != nil {
+		params = params.Disabled(*update.Disabled)
+	}
+	if update.CustomClaims != nil {
+		params = params.CustomClaims(update.CustomClaims)
+	}
+	if update.ProviderToLink != nil {
+		params = params.ProviderToLink(update.ProviderToLink)
+	}
+	if len(update.ProvidersToDelete) > 0 {
+		params = params.ProvidersToDelete(update.ProvidersToDelete)
+	}
+
+	user, err := f.client.UpdateUser(ctx, uid, params)
+	f.auditUpdate(ctx, uid, update.Password != nil, update.CustomClaims != nil, update.Disabled, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if update.Disabled != nil && *update.Disabled {
+		f.invalidateCachedTokens(uid)
+	}
+
+	return user, nil
+}
+
+// auditUpdate emits an event for each security relevant change of an account update
+func (f *FirebaseAuth) auditUpdate(ctx context.Context, uid string, password bool, claims bool, disabled *bool, err error) {
+	if password {
+		f.audit(ctx, &AuditEvent{Type: AuditPasswordChanged, UID: uid}, err)
+	}
+	if claims {
+		f.audit(ctx, &AuditEvent{Type: AuditClaimsChanged, UID: uid}, err)
+	}
+	if disabled != nil {
+		event := &AuditEvent{Type: AuditAccountEnabled, UID: uid}
+		if *disabled {
+			event.Type = AuditAccountDisabled
+		}
+		f.audit(ctx, event, err)
+	}
+}
+
+// checkUpdatePassword applies the password policy, looking up the current email when the update keeps it
+func (f *FirebaseAuth) checkUpdatePassword(ctx context.Context, uid string, update *UserUpdate) error {
+	if f.passwordPolicy == nil {
+		return nil
+	}
+
+	var email string
+	if update.Email != nil {
+		email = *update.Email
+	} else if f.passwordPolicy.DisallowEmail {
+		user, err := f.client.GetUser(ctx, uid)
+		if err != nil {
+			return err
+		}
+		email = user.Email
+	}
+
+	return f.checkPassword(ctx, *update.Password, email)
+}
@@ -0,0 +1,528 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+	"google.golang.org/api/iterator"
+)
+
+// maxBatchUsers is the most users the Admin SDK imports or deletes in one call
+const maxBatchUsers = 1000
+
+// phonePattern is the loose E.164 check the Admin SDK applies
+var phonePattern = regexp.MustCompile(`\+.*[0-9A-Za-z]`)
+
+// UserFilter narrows the users returned by Users. Zero values match everything.
+type UserFilter struct {
+	Provider         string // provider ID such as "password" or "google.com"
+	Disabled         *bool
+	EmailVerified    *bool
+	CreatedAfter     time.Time
+	CreatedBefore    time.Time
+	LastSignInAfter  time.Time
+	LastSignInBefore time.Time
+}
+
+// Match reports whether user passes the filter
+func (uf *UserFilter) Match(user *auth.UserRecord) bool {
+	if uf == nil {
+		return true
+	}
+
+	if uf.Disabled != nil && user.Disabled != *uf.Disabled {
+		return false
+	}
+	if uf.EmailVerified != nil && user.EmailVerified != *uf.EmailVerified {
+		return false
+	}
+
+	if uf.Provider != "" {
+		found := false
+		for _, info := range user.ProviderUserInfo {
+			if info.ProviderID == uf.Provider {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	var created, lastSignIn time.Time
+	if user.UserMetadata != nil {
+		created = time.UnixMilli(user.UserMetadata.CreationTimestamp)
+		lastSignIn = time.UnixMilli(user.UserMetadata.LastLogInTimestamp)
+	}
+
+	return inRange(created, uf.CreatedAfter, uf.CreatedBefore) && inRange(lastSignIn, uf.LastSignInAfter, uf.LastSignInBefore)
+}
+
+// GetUser
+func (f *FirebaseAuth) GetUser(uid string) (*auth.UserRecord, error) {
+	return f.GetUserContext(context.Background(), uid)
+}
+
+// GetUserContext returns the user record of uid
+func (f *FirebaseAuth) GetUserContext(ctx context.Context, uid string) (*auth.UserRecord, error) {
+	return f.client.GetUser(ctx, uid)
+}
+
+// UserIterator iterates over the users matching a UserFilter
+type UserIterator struct {
+	it     *auth.UserIterator
+	filter *UserFilter
+}
+
+// Users returns an iterator over all users matching filter, which may be nil.
+// Next returns iterator.Done once there are no more users.
+func (f *FirebaseAuth) Users(ctx context.Context, filter *UserFilter) *UserIterator {
+	return &UserIterator{
+		it:     f.client.Users(ctx, ""),
+		filter: filter,
+	}
+}
+
+// Next returns the next matching user, or iterator.Done
+func (ui *UserIterator) Next() (*auth.ExportedUserRecord, error) {
+	for {
+		user, err := ui.it.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		if ui.filter.Match(user.UserRecord) {
+			return user, nil
+		}
+	}
+}
+
+// UserExport is one line of a JSONL export, and the format ImportUsersJSONL reads back.
+// PasswordHash and PasswordSalt are base64 encoded, as returned by Firebase.
+type UserExport struct {
+	UID           string                 `json:"uid"`
+	Email         string                 `json:"email,omitempty"`
+	EmailVerified bool                   `json:"emailVerified"`
+	DisplayName   string                 `json:"displayName,omitempty"`
+	PhoneNumber   string                 `json:"phoneNumber,omitempty"`
+	PhotoURL      string                 `json:"photoURL,omitempty"`
+	Disabled      bool                   `json:"disabled"`
+	Providers     []string               `json:"providers,omitempty"`
+	ProviderData  []ProviderExport       `json:"providerData,omitempty"` // JSONL only, the CSV keeps the IDs
+	CustomClaims  map[string]interface{} `json:"customClaims,omitempty"`
+	PasswordHash  string                 `json:"passwordHash,omitempty"`
+	PasswordSalt  string                 `json:"passwordSalt,omitempty"`
+	CreatedAt     int64                  `json:"createdAt,omitempty"`    // milliseconds since epoch
+	LastSignInAt  int64                  `json:"lastSignInAt,omitempty"` // milliseconds since epoch
+}
+
+// ProviderExport is a provider linked to an exported user
+type ProviderExport struct {
+	ProviderID  string `json:"providerId"`
+	UID         string `json:"rawId"` // the user's ID at the provider
+	Email       string `json:"email,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+	PhotoURL    string `json:"photoUrl,omitempty"`
+}
+
+// NewUserExport converts an exported user record
+func NewUserExport(user *auth.ExportedUserRecord) *UserExport {
+	out := &UserExport{
+		UID:           user.UID,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		DisplayName:   user.DisplayName,
+		PhoneNumber:   user.PhoneNumber,
+		PhotoURL:      user.PhotoURL,
+		Disabled:      user.Disabled,
+		CustomClaims:  user.CustomClaims,
+		PasswordHash:  user.PasswordHash,
+		PasswordSalt:  user.PasswordSalt,
+	}
+
+	for _, info := range user.ProviderUserInfo {
+		out.Providers = append(out.Providers, info.ProviderID)
+		out.ProviderData = append(out.ProviderData, ProviderExport{
+			ProviderID:  info.ProviderID,
+			UID:         info.UID,
+			Email:       info.Email,
+			DisplayName: info.DisplayName,
+			PhotoURL:    info.PhotoURL,
+		})
+	}
+
+	if user.UserMetadata != nil {
+		out.CreatedAt = user.UserMetadata.CreationTimestamp
+		out.LastSignInAt = user.UserMetadata.LastLogInTimestamp
+	}
+
+	return out
+}
+
+// ExportUsersJSONL writes every user matching filter to w as one JSON object per line and returns the count
+func (f *FirebaseAuth) ExportUsersJSONL(ctx context.Context, w io.Writer, filter *UserFilter) (int, error) {
+	enc := json.NewEncoder(w)
+
+	return f.exportUsers(ctx, filter, func(user *UserExport) error {
+		return enc.Encode(user)
+	})
+}
+
+// ExportUsersCSV writes every user matching filter to w as CSV with a header row and returns the count.
+// Providers are separated by ";" and custom claims are written as JSON. Only the provider IDs are
+// written, so use ExportUsersJSONL for an export that ImportUsersJSONL can restore provider links from.
+func (f *FirebaseAuth) ExportUsersCSV(ctx context.Context, w io.Writer, filter *UserFilter) (int, error) {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write([]string{"uid", "email", "emailVerified", "displayName", "phoneNumber", "photoURL",
+		"disabled", "providers", "customClaims", "passwordHash", "passwordSalt", "createdAt", "lastSignInAt"}); err != nil {
+		return 0, err
+	}
+
+	count, err := f.exportUsers(ctx, filter, func(user *UserExport) error {
+		claims := ""
+		if len(user.CustomClaims) > 0 {
+			data, err := json.Marshal(user.CustomClaims)
+			if err != nil {
+				return err
+			}
+			claims = string(data)
+		}
+
+		return cw.Write([]string{
+			user.UID, user.Email, strconv.FormatBool(user.EmailVerified), user.DisplayName, user.PhoneNumber, user.PhotoURL,
+			strconv.FormatBool(user.Disabled), strings.Join(user.Providers, ";"), claims, user.PasswordHash, user.PasswordSalt,
+			strconv.FormatInt(user.CreatedAt, 10), strconv.FormatInt(user.LastSignInAt, 10),
+		})
+	})
+
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+
+	return count, err
+}
+
+// exportUsers
+func (f *FirebaseAuth) exportUsers(ctx context.Context, filter *UserFilter, write func(user *UserExport) error) (int, error) {
+	it := f.Users(ctx, filter)
+	count := 0
+
+	for {
+		user, err := it.Next()
+		if err == iterator.Done {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if err = write(NewUserExport(user)); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// ImportFailure describes a user that could not be imported
+type ImportFailure struct {
+	Line   int // 1-based line in the input
+	UID    string
+	Reason string
+}
+
+// ImportReport summarises an ImportUsersJSONL run
+type ImportReport struct {
+	Total     int
+	Succeeded int
+	Failures  []ImportFailure
+}
+
+// ImportUsersJSONL imports users from UserExport lines in batches of 1000. hash describes how the password
+// hashes were produced (e.g. hash.Scrypt, hash.Bcrypt from firebase.google.com/go/v4/auth/hash) and may
+// be nil when no line carries a password. Every line is validated before it is sent, since the Admin SDK
+// rejects a whole batch for one invalid user, and lines that fail are reported instead of aborting the
+// import. Federated providers in ProviderData are linked again; the password and phone providers follow
+// from the password hash and phone number. Lines without ProviderData, e.g. from older exports, lose
+// their provider links.
+func (f *FirebaseAuth) ImportUsersJSONL(ctx context.Context, r io.Reader, hash auth.UserImportHash) (*ImportReport, error) {
+	report := &ImportReport{}
+
+	var opts []auth.UserImportOption
+	if hash != nil {
+		opts = append(opts, auth.WithHash(hash))
+	}
+
+	var batch []*auth.UserToImport
+	var batchLines []int
+	var batchUIDs []string
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		result, err := f.client.ImportUsers(ctx, batch, opts...)
+		if err != nil {
+			return err
+		}
+
+		report.Succeeded += result.SuccessCount
+		for _, e := range result.Errors {
+			report.Failures = append(report.Failures, ImportFailure{Line: batchLines[e.Index], UID: batchUIDs[e.Index], Reason: e.Reason})
+		}
+
+		batch, batchLines, batchUIDs = batch[:0], batchLines[:0], batchUIDs[:0]
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		report.Total++
+
+		var rec UserExport
+		if err := json.Unmarshal([]byte(text), &rec); err != nil {
+			report.Failures = append(report.Failures, ImportFailure{Line: line, Reason: err.Error()})
+			continue
+		}
+
+		user, err := rec.toImport(hash != nil)
+		if err != nil {
+			report.Failures = append(report.Failures, ImportFailure{Line: line, UID: rec.UID, Reason: err.Error()})
+			continue
+		}
+
+		batch = append(batch, user)
+		batchLines = append(batchLines, line)
+		batchUIDs = append(batchUIDs, rec.UID)
+
+		if len(batch) == maxBatchUsers {
+			if err = flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return report, err
+	}
+
+	return report, flush()
+}
+
+// toImport checks the record the way the Admin SDK does, so an invalid line fails on its own.
+// hashed reports whether a hash configuration was given for password hashes.
+func (u *UserExport) toImport(hashed bool) (*auth.UserToImport, error) {
+	if err := u.validate(hashed); err != nil {
+		return nil, err
+	}
+
+	user := (&auth.UserToImport{}).
+		UID(u.UID).
+		EmailVerified(u.EmailVerified).
+		Disabled(u.Disabled)
+
+	if u.Email != "" {
+		user = user.Email(u.Email)
+	}
+	if u.DisplayName != "" {
+		user = user.DisplayName(u.DisplayName)
+	}
+	if u.PhoneNumber != "" {
+		user = user.PhoneNumber(u.PhoneNumber)
+	}
+	if u.PhotoURL != "" {
+		user = user.PhotoURL(u.PhotoURL)
+	}
+	if len(u.CustomClaims) > 0 {
+		user = user.CustomClaims(u.CustomClaims)
+	}
+	if u.CreatedAt > 0 || u.LastSignInAt > 0 {
+		user = user.Metadata(&auth.UserMetadata{
+			CreationTimestamp:  u.CreatedAt,
+			LastLogInTimestamp: u.LastSignInAt,
+		})
+	}
+
+	var providers []*auth.UserProvider
+	for _, p := range u.ProviderData {
+		if p.ProviderID == ProviderPassword || p.ProviderID == ProviderPhone {
+			continue
+		}
+		providers = append(providers, &auth.UserProvider{
+			UID:         p.UID,
+			ProviderID:  p.ProviderID,
+			Email:       p.Email,
+			DisplayName: p.DisplayName,
+			PhotoURL:    p.PhotoURL,
+		})
+	}
+	if len(providers) > 0 {
+		user = user.ProviderData(providers)
+	}
+
+	if u.PasswordHash != "" {
+		h, err := decodeBase64(u.PasswordHash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid passwordHash: %v", err)
+		}
+		user = user.PasswordHash(h)
+
+		if u.PasswordSalt != "" {
+			salt, err := decodeBase64(u.PasswordSalt)
+			if err != nil {
+				return nil, fmt.Errorf("invalid passwordSalt: %v", err)
+			}
+			user = user.PasswordSalt(salt)
+		}
+	}
+
+	return user, nil
+}
+
+// validate
+func (u *UserExport) validate(hashed bool) error {
+	if u.UID == "" {
+		return fmt.Errorf("uid is required")
+	}
+	if len(u.UID) > 128 {
+		return fmt.Errorf("uid must not be longer than 128 characters")
+	}
+	if u.Email != "" {
+		if local, domain, ok := strings.Cut(u.Email, "@"); !ok || local == "" || domain == "" || strings.Contains(domain, "@") {
+			return fmt.Errorf("malformed email %q", u.Email)
+		}
+	}
+	if u.PhoneNumber != "" && !phonePattern.MatchString(u.PhoneNumber) {
+		return fmt.Errorf("phone number %q is not E.164", u.PhoneNumber)
+	}
+	if len(u.CustomClaims) > 0 {
+		if err := checkBlockingClaims("custom", u.CustomClaims); err != nil {
+			return err
+		}
+	}
+	if u.PasswordHash != "" && !hashed {
+		return fmt.Errorf("password hash needs a hash configuration")
+	}
+
+	for _, p := range u.ProviderData {
+		if p.ProviderID == "" || p.UID == "" {
+			return fmt.Errorf("provider needs a providerId and rawId")
+		}
+	}
+
+	return nil
+}
+
+// DeleteUser deletes a single user
+func (f *FirebaseAuth) DeleteUser(ctx context.Context, uid string) error {
+	err := f.client.DeleteUser(ctx, uid)
+	f.audit(ctx, &AuditEvent{Type: AuditAccountDeleted, UID: uid}, err)
+
+	if err != nil {
+		return err
+	}
+
+	f.invalidateCachedTokens(uid)
+
+	return nil
+}
+
+// DeleteFailure describes a user that could not be deleted
+type DeleteFailure struct {
+	UID    string
+	Reason string
+}
+
+// DeleteReport summarises a DeleteUsers run
+type DeleteReport struct {
+	Succeeded int
+	Failures  []DeleteFailure
+}
+
+// DeleteUsers deletes users in batches of 1000. Users that do not exist count as deleted.
+func (f *FirebaseAuth) DeleteUsers(ctx context.Context, uids []string) (*DeleteReport, error) {
+	report := &DeleteReport{}
+
+	for start := 0; start < len(uids); start += maxBatchUsers {
+		end := start + maxBatchUsers
+		if end > len(uids) {
+			end = len(uids)
+		}
+		chunk := uids[start:end]
+
+		result, err := f.client.DeleteUsers(ctx, chunk)
+		if err != nil {
+			for _, uid := range chunk {
+				f.audit(ctx, &AuditEvent{Type: AuditAccountDeleted, UID: uid}, err)
+			}
+			return report, err
+		}
+
+		failed := make(map[int]string, len(result.Errors))
+		for _, e := range result.Errors {
+			failed[e.Index] = e.Reason
+			report.Failures = append(report.Failures, DeleteFailure{UID: chunk[e.Index], Reason: e.Reason})
+		}
+		report.Succeeded += result.SuccessCount
+
+		for i, uid := range chunk {
+			f.invalidateCachedTokens(uid)
+
+			var deleteErr error
+			if reason, ok := failed[i]; ok {
+				deleteErr = errors.New(reason)
+			}
+			f.audit(ctx, &AuditEvent{Type: AuditAccountDeleted, UID: uid}, deleteErr)
+		}
+	}
+
+	return report, nil
+}
+
+// inRange treats zero bounds as open
+func inRange(t time.Time, after time.Time, before time.Time) bool {
+	if !after.IsZero() && !t.After(after) {
+		return false
+	}
+	if !before.IsZero() && !t.Before(before) {
+		return false
+	}
+
+	return true
+}
+
+// decodeBase64 accepts the URL-safe and standard alphabets, padded or not
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "+/") {
+		return base64.RawStdEncoding.DecodeString(s)
+	}
+
+	return base64.RawURLEncoding.DecodeString(s)
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2021. Victor Ruscitto (vrus@vrcyber.com). All rights reserved.
+ */
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+const (
+	firebaseIssuerPrefix = "https://securetoken.google.com/"
+
+	// defaultClockSkew is the leeway allowed on exp and iat
+	defaultClockSkew = 5 * time.Minute
+)
+
+// TokenVerifier verifies Firebase ID tokens. *auth.Client and *auth.TenantClient from the Admin SDK
+// implement it, and LocalVerifier implements it without network access.
+type TokenVerifier interface {
+	VerifyIDToken(ctx context.Context, idToken string) (*auth.Token, error)
+}
+
+// WithTokenVerifier replaces the Admin SDK for ID token verification in VerifyToken, GetRoleFromToken
+// and the middleware. Revocation checks still go through the Admin SDK.
+func WithTokenVerifier(v TokenVerifier) Option {
+	return func(f *FirebaseAuth) {
+		f.verifier = v
+	}
+}
+
+// tokenVerifier
+func (f *FirebaseAuth) tokenVerifier() TokenVerifier {
+	if f.verifier != nil {
+		return f.verifier
+	}
+
+	return f.client
+}
+
+// LocalVerifier verifies RS256 Firebase ID tokens against a KeySource, checking the
+// issuer, audience, expiry and subject the same way the Admin SDK does
+type LocalVerifier struct {
+	projectID string
+	keys      KeySource
+	skew      time.Duration
+	now       func() time.Time
+}
+
+// NewLocalVerifier
+func NewLocalVerifier(projectID string, keys KeySource) *LocalVerifier {
+	return &LocalVerifier{
+		projectID: projectID,
+		keys:      keys,
+		skew:      defaultClockSkew,
+		now:       time.Now,
+	}
+}
+
+// SetClock replaces time.Now, e.g. to verify tokens minted at a fixed time in tests
+func (v *LocalVerifier) SetClock(now func() time.Time) {
+	v.now = now
+}
+
+// VerifyIDToken
+func (v *LocalVerifier) VerifyIDToken(ctx context.Context, idToken string) (*auth.Token, error) {
+	t, err := parseJWT(idToken)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := v.keys.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.verifyWithKeys(keys); err != nil {
+		return nil, err
+	}
+
+	if iss := t.str("iss"); iss != firebaseIssuerPrefix+v.projectID {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, iss)
+	}
+	if !t.hasAudience(v.projectID) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+	if sub := t.str("sub"); sub == "" || len(sub) > 128 {
+		return nil, fmt.Errorf("%w: invalid subject", ErrInvalidToken)
+	}
+	if err = t.checkTimes(v.now(), v.skew); err != nil {
+		return nil, err
+	}
+
+	return newToken(t)
+}
+
+// newToken builds an auth.Token from verified claims, matching what the Admin SDK returns
+func newToken(t *jwt) (*auth.Token, error) {
+	token := &auth.Token{
+		AuthTime: t.num("auth_time"),
+		Issuer:   t.str("iss"),
+		Expires:  t.num("exp"),
+		IssuedAt: t.num("iat"),
+		Subject:  t.str("sub"),
+		UID:      t.str("sub"),
+		Claims:   make(map[string]interface{}, len(t.claims)),
+	}
+
+	if aud, ok := t.claims["aud"].(string); ok {
+		token.Audience = aud
+	}
+
+	if fb, ok := t.claims["firebase"]; ok {
+		data, err := json.Marshal(fb)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &token.Firebase); err != nil {
+			return nil, fmt.Errorf("%w: invalid firebase claim: %v", ErrInvalidToken, err)
+		}
+	}
+
+	for k, val := range t.claims {
+		switch k {
+		case "iss", "aud", "exp", "iat", "sub", "uid":
+		default:
+			token.Claims[k] = val
+		}
+	}
+
+	return token, nil
+}
@@ -11,6 +11,7 @@ require (
 	cloud.google.com/go/storage v1.40.0
 	firebase.google.com/go/v4 v4.14.0
 	github.com/gomodule/redigo v1.9.2
+	google.golang.org/api v0.179.0
 	google.golang.org/protobuf v1.34.1
 )
 
@@ -46,7 +47,6 @@ require (
 	golang.org/x/sys v0.20.0 // indirect
 	golang.org/x/text v0.15.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
-	google.golang.org/api v0.179.0 // indirect
 	google.golang.org/appengine/v2 v2.0.6 // indirect
 	google.golang.org/genproto v0.0.0-20240401170217-c3f982113cda // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20240509183442-62759503f434 // indirect
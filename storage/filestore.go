@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
 )
 
 type FileStore struct {
@@ -76,6 +77,27 @@ func (f *FileStore) DeleteFile(bucket string, filename string) error {
 	return nil
 }
 
+// ListFiles returns the names of the objects in bucket starting with prefix
+func (f *FileStore) ListFiles(bucket string, prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*50)
+	defer cancel()
+
+	var names []string
+
+	it := f.client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return names, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bucket(%s).Objects: %v", bucket, err)
+		}
+
+		names = append(names, attrs.Name)
+	}
+}
+
 // Close
 func (f *FileStore) Close() {
 	f.client.Close()
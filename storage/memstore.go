@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -87,10 +88,21 @@ func (m *MemStore) IncrementAndExpire(key string, maxValue int, expiry float64)
 		return tokens, false
 	}
 
-	conn.Do("MULTI")
-	tokens, err = redis.Int(conn.Do("INCR", key))
-	conn.Do("EXPIRE", key, expiry)
-	conn.Do("EXEC")
+	// inside MULTI each command only replies QUEUED, the results come back from EXEC
+	conn.Send("MULTI")
+	conn.Send("INCR", key)
+	conn.Send("EXPIRE", key, int(math.Ceil(expiry)))
+
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil || len(replies) == 0 {
+		log.Printf("failed to increment key %v. %v", key, err)
+		return 0, false
+	}
+
+	if tokens, err = redis.Int(replies[0], nil); err != nil {
+		log.Printf("failed to increment key %v. %v", key, err)
+		return 0, false
+	}
 
 	return tokens, true
 }
@@ -195,6 +207,36 @@ func (m *MemStore) DeleteKey(key string) bool {
 	return true
 }
 
+// ScanKeys returns the keys matching a glob pattern. It uses SCAN, so Redis is not blocked like with KEYS.
+func (m *MemStore) ScanKeys(pattern string) ([]string, error) {
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	var keys []string
+	cursor := 0
+
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan keys %v. %v", pattern, err)
+		}
+
+		if cursor, err = redis.Int(values[0], nil); err != nil {
+			return nil, err
+		}
+
+		batch, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
 // IncrementKey will attempt to increment a key
 func (m *MemStore) IncrementKey(key string) int {
 	conn := m.pool.Get()